@@ -0,0 +1,142 @@
+package securenet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Seals frames of version 4 and later, the server picks it and its ID is bound
+// to the session key, so a changed choice makes the first frame fail to open.
+// Earlier versions always use NaClBox
+type AEAD interface {
+	// Identifies the cipher in the server's hello, must be non-zero
+	ID() byte
+	// The cipher.AEAD must take nonces of at most 24 bytes and add box.Overhead bytes
+	New(key *[32]byte) (cipher.AEAD, error)
+}
+
+// XSalsa20-Poly1305 as in golang.org/x/crypto/nacl/box, additional data is not supported
+var NaClBox AEAD = naclBox{}
+
+// XChaCha20-Poly1305 from golang.org/x/crypto/chacha20poly1305
+var XChaCha20Poly1305 AEAD = xChaCha20Poly1305{}
+
+// AES-256-GCM from crypto/aes, which is hardware accelerated on most platforms
+var AESGCM AEAD = aesGCM{}
+
+var builtinAEADs = []AEAD{NaClBox, XChaCha20Poly1305, AESGCM}
+
+type naclBox struct{}
+
+func (naclBox) ID() byte {
+	return 1
+}
+
+func (naclBox) New(key *[32]byte) (cipher.AEAD, error) {
+	return &secretboxAEAD{key}, nil
+}
+
+type xChaCha20Poly1305 struct{}
+
+func (xChaCha20Poly1305) ID() byte {
+	return 2
+}
+
+func (xChaCha20Poly1305) New(key *[32]byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key[:])
+}
+
+type aesGCM struct{}
+
+func (aesGCM) ID() byte {
+	return 3
+}
+
+func (aesGCM) New(key *[32]byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+var errOpen = errors.New("secretbox: message authentication failed")
+
+// The key is shared with the conn, which replaces rather than overwrites it
+type secretboxAEAD struct {
+	key *[32]byte
+}
+
+func (a *secretboxAEAD) NonceSize() int {
+	return 24
+}
+
+func (a *secretboxAEAD) Overhead() int {
+	return secretbox.Overhead
+}
+
+func (a *secretboxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(additionalData) > 0 {
+		panic("securenet: NaClBox does not support additional data")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, a.key)
+}
+
+func (a *secretboxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(additionalData) > 0 {
+		panic("securenet: NaClBox does not support additional data")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	opened, ok := secretbox.Open(dst, ciphertext, &n, a.key)
+	if !ok {
+		return nil, errOpen
+	}
+	return opened, nil
+}
+
+// The AEAD for a key is built on first use and kept until the key is replaced
+type keyedAEAD struct {
+	key  *[32]byte
+	aead cipher.AEAD
+}
+
+func (k *keyedAEAD) get(a AEAD, key *[32]byte) (aead cipher.AEAD, err error) {
+	if k.key == key {
+		return k.aead, nil
+	}
+	aead, err = a.New(key)
+	if err != nil {
+		return
+	}
+	if aead.NonceSize() > 24 || aead.Overhead() != box.Overhead {
+		return nil, fmt.Errorf("%w: AEAD %d takes %d byte nonces and adds %d bytes", ErrUnsupportedAEAD, a.ID(), aead.NonceSize(), aead.Overhead())
+	}
+	k.key, k.aead = key, aead
+	return
+}
+
+// Clients accept any built-in AEAD unless Config.AEAD is set
+func clientAEAD(id byte, config *Config) (a AEAD, err error) {
+	if config != nil && config.AEAD != nil {
+		if config.AEAD.ID() != id {
+			err = fmt.Errorf("%w: server picked %d instead of %d", ErrUnsupportedAEAD, id, config.AEAD.ID())
+			return
+		}
+		return config.AEAD, nil
+	}
+	for _, a = range builtinAEADs {
+		if a.ID() == id {
+			return
+		}
+	}
+	return nil, fmt.Errorf("%w: server picked %d", ErrUnsupportedAEAD, id)
+}
@@ -0,0 +1,125 @@
+package securenet
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Messages shorter than this are always sent uncompressed
+const minCompressSize = 64
+
+// Compressing secrets together with attacker-controlled data in one message
+// leaks the secrets through the compressed length, as in CRIME and BREACH.
+// Only WriteMessage compresses, so the caller decides what shares a frame
+type Compression interface {
+	// Identifies the codec on the wire, must be non-zero and the same on both sides
+	ID() byte
+	Compress(dst, src []byte) ([]byte, error)
+	// Fails once the output would grow beyond max bytes
+	Decompress(dst, src []byte, max int) ([]byte, error)
+}
+
+// DEFLATE at the default compression level
+var Flate Compression = flateCompression{}
+
+type flateCompression struct{}
+
+func (flateCompression) ID() byte {
+	return 1
+}
+
+func (flateCompression) Compress(dst, src []byte) (out []byte, err error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	out = buf.Bytes()
+	return
+}
+
+func (flateCompression) Decompress(dst, src []byte, max int) (out []byte, err error) {
+	buf := bytes.NewBuffer(dst)
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	n, err := io.Copy(buf, io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return
+	}
+	if n > int64(max) {
+		err = fmt.Errorf("%w: decompresses beyond %d bytes", ErrFrameTooLarge, max)
+		return
+	}
+	out = buf.Bytes()
+	return
+}
+
+// Each side announces its codec before its first message and the peer only
+// compresses once it read that announcement, unless the handshake picked the
+// codec, as it does from version 9 on
+func (c *conn) announceCompression() (err error) {
+	if c.announced || c.codecAgreed || c.config == nil || c.config.Compression == nil {
+		return
+	}
+	err = c.writeRawFrame(frameCompression, []byte{c.config.Compression.ID()})
+	if err != nil {
+		return
+	}
+	c.announced = true
+	return
+}
+
+func (c *conn) handleCompression(b []byte) (err error) {
+	if c.codecAgreed {
+		return fmt.Errorf("%w: compression announced after the handshake picked a codec", ErrMalformedFrame)
+	}
+	if len(b) != 1 || b[0] == 0 {
+		return fmt.Errorf("%w: compression frame of %d bytes", ErrMalformedFrame, len(b))
+	}
+	atomic.StoreUint32(&c.peerCompression, uint32(b[0]))
+	return
+}
+
+// The body of a compressed frame is the codec ID followed by the compressed message
+func (c *conn) compress(b []byte) (frameType byte, body []byte, err error) {
+	frameType, body = frameData, b
+	if c.config == nil || c.config.Compression == nil || len(b) < minCompressSize {
+		return
+	}
+	codec := c.config.Compression
+	if atomic.LoadUint32(&c.peerCompression) != uint32(codec.ID()) {
+		return
+	}
+	compressed, err := codec.Compress([]byte{codec.ID()}, b)
+	if err != nil || len(compressed) >= len(b) {
+		return
+	}
+	frameType, body = frameCompressed, compressed
+	return
+}
+
+func (c *conn) decompress(b []byte) (decompressed []byte, err error) {
+	unknown := len(b) == 0 || c.config == nil || c.config.Compression == nil || c.config.Compression.ID() != b[0]
+	if unknown || (c.codecAgreed && atomic.LoadUint32(&c.peerCompression) != uint32(b[0])) {
+		err = fmt.Errorf("%w: compressed with an unknown codec", ErrMalformedFrame)
+		return
+	}
+	decompressed, err = c.config.Compression.Decompress(c.decompressed[:0], b[1:], int(c.maxFrameSize))
+	if err != nil {
+		return
+	}
+	if len(decompressed) == 0 {
+		err = fmt.Errorf("%w: compressed frame is empty", ErrMalformedFrame)
+		return
+	}
+	c.decompressed = decompressed
+	return
+}
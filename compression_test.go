@@ -0,0 +1,119 @@
+package securenet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var compressible = bytes.Repeat([]byte("compressible "), 400)
+
+// How many bytes the client put on the wire for one message
+func sendCompressible(t *testing.T, client, server Conn, recorded *recordingConn) int {
+	t.Helper()
+	before := len(recorded.bytes())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.WriteMessage(compressible)
+	}()
+	m, err := server.ReadMessage()
+	if err != nil || !bytes.Equal(m, compressible) {
+		t.Fatal(len(m), err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return len(recorded.bytes()) - before
+}
+
+func TestNegotiatedCompression(t *testing.T) {
+	client, server, recorded := recordedConns(t, &Config{Compression: Flate}, &Config{Compression: Flate})
+	if n := sendCompressible(t, client, server, recorded); n >= len(compressible)/2 {
+		t.Fatal("first message sent with", n, "bytes")
+	}
+	// Nothing but the message itself, no announcement
+	if frames := client.Stats().FramesSent; frames != 1 {
+		t.Fatal(frames, "frames sent")
+	}
+	go server.WriteMessage(compressible)
+	m, err := client.ReadMessage()
+	if err != nil || !bytes.Equal(m, compressible) {
+		t.Fatal(len(m), err)
+	}
+}
+
+func TestCompressionMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		client, server *Config
+	}{
+		{"ClientOnly", &Config{Compression: Flate}, nil},
+		{"ServerOnly", nil, &Config{Compression: Flate}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server, recorded := recordedConns(t, tc.client, tc.server)
+			if n := sendCompressible(t, client, server, recorded); n < len(compressible) {
+				t.Fatal("sent compressed with", n, "bytes")
+			}
+		})
+	}
+}
+
+// Version 8 peers still announce their codec in a control frame
+func TestVersion8Compression(t *testing.T) {
+	client, server, recorded := recordedConns(t, &Config{Compression: Flate, MaxVersion: Version8}, &Config{Compression: Flate})
+	sendCompressible(t, client, server, recorded)
+	if frames := client.Stats().FramesSent; frames != 2 {
+		t.Fatal(frames, "frames sent")
+	}
+	go server.WriteMessage(compressible)
+	if _, err := client.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sendCompressible(t, client, server, recorded); n >= len(compressible)/2 {
+		t.Fatal("sent with", n, "bytes after the announcement")
+	}
+}
+
+func TestCompressionAnnouncedAfterHandshake(t *testing.T) {
+	client, server := testConns(t, &Config{Compression: Flate}, &Config{Compression: Flate})
+	if err := client.(*conn).writeControl(frameCompression, []byte{Flate.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ReadMessage(); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatal(err)
+	}
+}
+
+func TestResumedCompression(t *testing.T) {
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := testKeys(t)
+	serverConfig.TicketKeys, serverConfig.Compression = keys, Flate
+	clientConfig := testKeys(t)
+	clientConfig.SessionTicket = issuedTicket(t, clientConfig, serverConfig)
+	clientConfig.Compression = Flate
+	client, server, recorded := recordedConns(t, clientConfig, serverConfig)
+	if !client.ConnectionState().Resumed {
+		t.Fatal("not resumed")
+	}
+	if n := sendCompressible(t, client, server, recorded); n >= len(compressible)/2 {
+		t.Fatal("sent with", n, "bytes")
+	}
+}
+
+// Only messages that decompress count as received
+func TestCorruptCompressedFrame(t *testing.T) {
+	client, server := testConns(t, &Config{Compression: Flate}, &Config{Compression: Flate})
+	if err := client.(*conn).writeControl(frameCompressed, []byte{Flate.ID(), 0xff, 0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ReadMessage(); err == nil {
+		t.Fatal("corrupt message read")
+	}
+	if stats := server.Stats(); stats.DataFramesReceived != 0 || stats.BytesReceived != 0 {
+		t.Fatal(stats)
+	}
+}
@@ -0,0 +1,266 @@
+package securenet
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+
+	"github.com/coderobe/ed25519/extra25519"
+	"golang.org/x/crypto/curve25519"
+)
+
+const DefaultMaxFrameSize = 16 << 20
+const DefaultChunkSize = 64 << 10
+const DefaultRekeyAfterBytes = 1 << 30
+const DefaultRekeyAfterFrames = 1 << 24
+
+// Version 1 frames are a random nonce, the sealed header and the sealed body.
+// Version 2 frames drop the nonce, which both sides derive from the sequence number.
+// Version 3 seals each direction under its own key.
+// Version 4 lets the server pick the AEAD.
+// Version 5 ends every connection with a close frame.
+// Version 6 has both sides announce their MaxFrameSize.
+// Version 7 reads padded frames.
+// Version 8 adds a random value from each side to the transcript.
+// Version 9 negotiates compression in the handshake
+const (
+	Version1 = 1
+	Version2 = 2
+	Version3 = 3
+	Version4 = 4
+	Version5 = 5
+	Version6 = 6
+	Version7 = 7
+	Version8 = 8
+	Version9 = 9
+)
+
+const minVersion = Version1
+const maxVersion = Version9
+
+// A nil *Config uses the defaults for everything
+type Config struct {
+	// Static private key, a fresh keypair is generated for every use when nil
+	PrivateKey *[32]byte
+	// Elligator representative of the public key, computed from PrivateKey when nil,
+	// a representative of any other key fails with ErrInvalidRepresentative
+	Representative *[32]byte
+	// Maximum plaintext size of a single frame, defaults to DefaultMaxFrameSize.
+	// From version 6 on both sides keep to the lower of their sizes
+	MaxFrameSize uint32
+	// Writes are split into frames of at most this many plaintext bytes, defaults to DefaultChunkSize
+	ChunkSize uint32
+	// The send key is rotated after this many plaintext bytes, defaults to DefaultRekeyAfterBytes
+	RekeyAfterBytes uint64
+	// The send key is rotated after this many frames, defaults to DefaultRekeyAfterFrames
+	RekeyAfterFrames uint64
+	// When set, clients reject servers presenting any other public key
+	ServerPublicKey *[32]byte
+	// When set, servers close connections from clients it returns false for
+	AuthorizeClient func(pub *[32]byte) bool
+	// When set, both sides call this once the handshake completed and before any
+	// data is sent or received. An error closes the connection and is returned
+	// from the handshake. Connections from a Listener handshake lazily, so their
+	// peer is only verified on the first read or write, or on Handshake
+	VerifyPeer func(state ConnectionState) error
+	// When set, the session key is derived from per-connection ephemeral keys
+	// authenticated by the static keys, both sides must agree on this
+	Ephemeral bool
+	// When set, the handshake is Noise_XX_25519_ChaChaPoly_SHA256 instead and
+	// frames are Noise transport messages, both sides must agree on this. It takes
+	// precedence over Ephemeral and never resumes. Only data is sent, so there is
+	// no compression, padding, rekeying, keepalive or ping
+	Noise bool
+	// Source of key material and nonces, defaults to crypto/rand.Reader
+	Rand io.Reader
+	// When set, connections not completing the handshake in time are closed
+	HandshakeTimeout time.Duration
+	// Size of the buffered reader on the underlying connection, defaults to 4096
+	ReadBufferSize int
+	// When set, this is mixed into the session key, both sides must use the same PSK.
+	// See the key derivation section of the README
+	PSK []byte
+	// When set, writes fail with ErrNonceReuse instead of repeating one of the
+	// recently sent nonces, which guards against a broken randomness source
+	DetectNonceReuse bool
+	// Highest protocol version offered in the handshake, defaults to the latest
+	MaxVersion uint8
+	// When set, a keepalive frame is sent after this long without writes, the peer acknowledges it
+	KeepAliveInterval time.Duration
+	// When set, the connection is closed once a read waited this long without
+	// anything arriving from the peer, and reads fail with ErrKeepAliveTimeout.
+	// A connection the application is not reading from never times out.
+	// This should be a few times the peer's KeepAliveInterval
+	KeepAliveTimeout time.Duration
+	// When set, messages sent with WriteMessage are compressed if the peer uses
+	// the same codec, see Compression for the risks
+	Compression Compression
+	// When set, this is called on handshakes, frames and decryption failures
+	OnEvent func(Event)
+	// The AEAD servers pick for version 4 and later, defaults to NaClBox.
+	// Clients with this set reject servers picking another, otherwise they accept any built-in one
+	AEAD AEAD
+	// When set, servers issue session tickets sealed under these keys after each handshake
+	// and resume sessions from them, see SessionTicket
+	TicketKeys *TicketKeys
+	// Servers refuse tickets older than this, defaults to DefaultTicketLifetime
+	TicketLifetime time.Duration
+	// When set, clients try to resume this session before falling back to a full handshake
+	SessionTicket *SessionTicket
+	// When set, Write collects up to this many bytes and sends them as one frame
+	// once full or on Flush. It is capped at ChunkSize
+	WriteBufferSize uint32
+	// When set on a client with ServerPublicKey, this is sent with its hello, a
+	// round trip before the handshake completes. An attacker can record and replay
+	// it to the server any number of times, so only send what is safe to repeat.
+	// Not sent with Ephemeral, Noise or SessionTicket, and at most 16 KiB
+	EarlyData []byte
+	// When set, servers read early data as the first message from the client,
+	// otherwise a client sending early data fails the handshake
+	AcceptEarlyData bool
+	// When set, the plaintext of every frame is padded up to a multiple of this
+	// many bytes from version 7 on, hiding the length of what was written
+	Padding uint32
+}
+
+func (c *Config) keys() (pub, priv, elligator [32]byte, err error) {
+	if c == nil || c.PrivateKey == nil {
+		return GenerateKeysWithRand(c.rand())
+	}
+	priv = *c.PrivateKey
+	if c.Representative != nil {
+		elligator = *c.Representative
+		maskRepresentative(&elligator)
+		curve25519.ScalarBaseMult(&pub, &priv)
+		var mapped [32]byte
+		extra25519.RepresentativeToPublicKey(&mapped, &elligator)
+		if !isValidRepresentative(&elligator) || mapped != pub {
+			err = ErrInvalidRepresentative
+		}
+		return
+	}
+	if !extra25519.ScalarBaseMult(&pub, &elligator, &priv) {
+		err = ErrNoRepresentative
+	}
+	return
+}
+
+func (c *Config) maxFrameSize() uint32 {
+	if c == nil || c.MaxFrameSize == 0 {
+		return DefaultMaxFrameSize
+	}
+	return c.MaxFrameSize
+}
+
+func (c *Config) chunkSize() uint32 {
+	size := uint32(DefaultChunkSize)
+	if c != nil && c.ChunkSize != 0 {
+		size = c.ChunkSize
+	}
+	if max := c.maxFrameSize(); size > max {
+		size = max
+	}
+	return size
+}
+
+func (c *Config) writeBufferSize() uint32 {
+	if c == nil {
+		return 0
+	}
+	if chunk := c.chunkSize(); c.WriteBufferSize > chunk {
+		return chunk
+	}
+	return c.WriteBufferSize
+}
+
+func (c *Config) padding() uint32 {
+	if c == nil {
+		return 0
+	}
+	return c.Padding
+}
+
+func (c *Config) rekeyAfterBytes() uint64 {
+	if c == nil || c.RekeyAfterBytes == 0 {
+		return DefaultRekeyAfterBytes
+	}
+	return c.RekeyAfterBytes
+}
+
+func (c *Config) rekeyAfterFrames() uint64 {
+	if c == nil || c.RekeyAfterFrames == 0 {
+		return DefaultRekeyAfterFrames
+	}
+	return c.RekeyAfterFrames
+}
+
+func (c *Config) rand() io.Reader {
+	if c == nil || c.Rand == nil {
+		return rand.Reader
+	}
+	return c.Rand
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.HandshakeTimeout
+}
+
+func (c *Config) readBufferSize() int {
+	if c == nil || c.ReadBufferSize == 0 {
+		return 4096
+	}
+	return c.ReadBufferSize
+}
+
+func (c *Config) psk() []byte {
+	if c == nil {
+		return nil
+	}
+	return c.PSK
+}
+
+func (c *Config) aead() AEAD {
+	if c == nil || c.AEAD == nil {
+		return NaClBox
+	}
+	return c.AEAD
+}
+
+// Zero without compression
+func (c *Config) compressionID() byte {
+	if c == nil || c.Compression == nil {
+		return 0
+	}
+	return c.Compression.ID()
+}
+
+func (c *Config) ticketKeys() *TicketKeys {
+	if c == nil {
+		return nil
+	}
+	return c.TicketKeys
+}
+
+func (c *Config) ticketLifetime() time.Duration {
+	if c == nil || c.TicketLifetime == 0 {
+		return DefaultTicketLifetime
+	}
+	return c.TicketLifetime
+}
+
+func (c *Config) maxVersion() uint8 {
+	if c == nil || c.MaxVersion == 0 || c.MaxVersion > maxVersion {
+		return maxVersion
+	}
+	return c.MaxVersion
+}
+
+func (c *Config) keepAlive() (interval, timeout time.Duration) {
+	if c == nil {
+		return
+	}
+	return c.KeepAliveInterval, c.KeepAliveTimeout
+}
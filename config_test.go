@@ -0,0 +1,26 @@
+package securenet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The same randomness on both ends yields the same keys, hellos and frames
+func TestFixedRand(t *testing.T) {
+	for _, version := range []uint8{Version1, maxVersion} {
+		var sessions [][]byte
+		for i := 0; i < 2; i++ {
+			clientConfig := &Config{Rand: &seedReader{seed: []byte("client")}, MaxVersion: version}
+			serverConfig := &Config{Rand: &seedReader{seed: []byte("server")}}
+			written, _ := staticSession(t, clientConfig, serverConfig, []byte("the same message"))
+			sessions = append(sessions, written)
+		}
+		if !bytes.Equal(sessions[0], sessions[1]) {
+			t.Fatal(version, "the same randomness wrote different bytes")
+		}
+		other := &Config{Rand: &seedReader{seed: []byte("other")}, MaxVersion: version}
+		if written, _ := staticSession(t, other, &Config{Rand: &seedReader{seed: []byte("server")}}, []byte("the same message")); bytes.Equal(written, sessions[0]) {
+			t.Fatal(version, "other randomness wrote the same bytes")
+		}
+	}
+}
@@ -2,203 +2,1011 @@ package securenet
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
-	"encoding/binary"
-	"errors"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coderobe/ed25519/extra25519"
-	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/hkdf"
 )
 
+// Close waits at most this long for pending writes and the close frame
+const closeTimeout = time.Second
+
+// One reader and one writer may proceed concurrently,
+// concurrent readers or concurrent writers are serialized.
+// LocalAddr and RemoteAddr are those of the wrapped connection
 type Conn interface {
 	net.Conn
 	io.ByteScanner
+	io.ReaderFrom
+	io.WriterTo
 	GetPublicKey() *[32]byte
 	GetServerPublicKey() *[32]byte
+	GetPeerFingerprint() string
+	ReadMessage() ([]byte, error)
+	ReadMessageInto(b []byte) (int, error)
+	WriteMessage([]byte) error
+	ReadString() (string, error)
+	ReadN(n int) ([]byte, error)
+	WriteString(s string) error
+	ReadMessageContext(ctx context.Context) ([]byte, error)
+	WriteMessageContext(ctx context.Context, b []byte) error
+	CloseWrite() error
+	SetReadBuffer(bytes int) error
+	SetReadTimeout(d time.Duration)
+	SetWriteTimeout(d time.Duration)
+	SetWriteBuffer(bytes int) error
+	Flush() error
+	SendStream(r io.Reader) error
+	RecvStream(w io.Writer) error
+	Rekey() error
+	Handshake(ctx context.Context) error
+	ConnectionState() ConnectionState
+	Ping(ctx context.Context) (time.Duration, error)
+	ExportKeyingMaterial(label string, length int) ([]byte, error)
+	Stats() Stats
+	BufferedBytes() int
+	Rehandshake(ctx context.Context) error
+	SessionTicket() *SessionTicket
+	Unwrap() (oc net.Conn, plaintext, raw []byte, err error)
+}
+
+type ConnectionState struct {
+	HandshakeComplete bool
+	// Whether the handshake resumed a session from a SessionTicket
+	Resumed        bool
+	Version        uint8
+	PeerPublicKey  [32]byte
+	LocalPublicKey [32]byte
+	// The largest frame either side sends, the lower of both sides' MaxFrameSize from version 6 on
+	MaxFrameSize uint32
+	// ID of the AEAD frames are sealed with, zero for the ChaCha20-Poly1305 of
+	// the Noise transport
+	AEAD byte
+	// Whether the client sent Config.EarlyData, which may have been replayed
+	EarlyData bool
+}
+
+// Byte counts are plaintext before compression, frame counts include control frames
+// and Rekeys counts key rotations in both directions. DataFramesReceived only
+// counts frames carrying data, BytesReceived over it is the average payload per frame
+type Stats struct {
+	BytesSent          uint64
+	BytesReceived      uint64
+	FramesSent         uint64
+	FramesReceived     uint64
+	DataFramesReceived uint64
+	DecryptFailures    uint64
+	Rekeys             uint64
 }
 
+// The atomically accessed fields come first to keep them 64-bit aligned
 type conn struct {
+	stats        Stats
+	lastSent     int64
+	lastReceived int64
+	pingID       uint64
+	// Length of buffer, for BufferedBytes
+	buffered     int64
+	peerTimedOut int32
+	// Set while a frame is read from the underlying connection
+	reading int32
+	// ID of the codec the peer announced or the handshake picked, zero until then
+	peerCompression uint32
+
 	net.Conn
-	bufferedRead    *bufio.Reader
-	lastRead        []byte
-	isUnread        bool
-	privateKey      *[32]byte
-	PublicKey       *[32]byte
-	ServerPublicKey *[32]byte
-	sharedKey       *[32]byte
-	buffer          []byte
+	bufferedRead     *bufio.Reader
+	lastRead         []byte
+	canUnread        bool
+	privateKey       *[32]byte
+	PublicKey        *[32]byte
+	ServerPublicKey  *[32]byte
+	sharedKey        *[32]byte
+	buffer           []byte
+	plaintext        []byte
+	openInto         []byte
+	maxFrameSize     uint32
+	chunkSize        uint32
+	padding          uint32
+	readLock         sync.Mutex
+	writeLock        sync.Mutex
+	readClosed       bool
+	writeClosed      bool
+	readSequence     uint64
+	writeSequence    uint64
+	sendKey          *[32]byte
+	recvKey          *[32]byte
+	aead             AEAD
+	sealer           keyedAEAD
+	opener           keyedAEAD
+	rekeyAfterBytes  uint64
+	rekeyAfterFrames uint64
+	sentSinceRekey   uint64
+	framesSinceRekey uint64
+	rand             io.Reader
+	isServer         bool
+
+	elligator         *[32]byte
+	config            *Config
+	handshakeComplete bool
+	stateLock         sync.RWMutex
+	version           uint8
+	sentNonces        *nonceHistory
+	sendNonceBase     [24]byte
+	recvNonceBase     [24]byte
+	done              chan struct{}
+	closeOnce         sync.Once
+	pingLock          sync.Mutex
+	pings             map[[8]byte]chan struct{}
+	announced         bool
+	decompressed      []byte
+	partial           []byte
+	rehandshakeLock   sync.Mutex
+	rehandshakePriv   *[32]byte
+	rehandshake       *rehandshakeRound
+	pendingRecvKey    *[32]byte
+	controlLock       sync.Mutex
+	controlQueue      []func()
+	controlFlushing   bool
+	pendingReplies    int
+	writeBufferSize   uint32
+	pendingWrite      []byte
+	resumptionSecret  *[32]byte
+	resumed           bool
+	earlyData         bool
+	unwrapped         bool
+	// Set when the handshake picked the codec, so nothing is announced
+	codecAgreed bool
+	// Set after a Noise handshake, frames are then Noise transport messages
+	noise bool
+	// Set on connections from a Listener, which handshake on first use
+	lazy          bool
+	handshakeErr  error
+	ticket        *SessionTicket
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	// Set while a done context holds the underlying deadline in the past
+	readExpired  bool
+	writeExpired bool
+}
+
+// Conn embeds net.Conn and io.ByteScanner, so this checks all three at compile time
+var _ Conn = (*conn)(nil)
+
+// The key getters return copies, nil until the handshake set the key
+func (c *conn) GetPublicKey() *[32]byte {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return copyKey(c.PublicKey)
+}
+
+func (c *conn) GetServerPublicKey() *[32]byte {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return copyKey(c.ServerPublicKey)
+}
+
+// This does not wait for pending reads or writes
+func (c *conn) ConnectionState() (state ConnectionState) {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	state.HandshakeComplete = c.handshakeComplete
+	state.Version = c.version
+	if c.aead != nil {
+		state.AEAD = c.aead.ID()
+	}
+	state.Resumed = c.resumed
+	state.EarlyData = c.earlyData
+	state.MaxFrameSize = c.maxFrameSize
+	if peer := c.peerPublicKey(); peer != nil {
+		state.PeerPublicKey = *peer
+	}
+	if c.isServer {
+		state.LocalPublicKey = *c.ServerPublicKey
+	} else {
+		state.LocalPublicKey = *c.PublicKey
+	}
+	return
+}
+
+// Both ends get the same output for the same label and length, the session key itself is never exposed.
+// This fails with ErrNotHandshaked before the handshake completed
+func (c *conn) ExportKeyingMaterial(label string, length int) (material []byte, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	if !c.handshakeComplete {
+		err = ErrNotHandshaked
+		return
+	}
+	select {
+	case <-c.done:
+		err = ErrClosed
+		return
+	default:
+	}
+	if length < 0 || length > 255*sha256.Size {
+		err = ErrExportLength
+		return
+	}
+	material = make([]byte, length)
+	info := append([]byte("securenet exporter "), label...)
+	io.ReadFull(hkdf.New(sha256.New, c.sharedKey[:], nil, info), material)
+	return
 }
 
-func (c conn) GetPublicKey() *[32]byte {
-	return c.PublicKey
+// Plaintext left over from the last frame that the next Read returns without reading
+// another frame. This does not wait for pending reads, which may change it
+func (c *conn) BufferedBytes() int {
+	return int(atomic.LoadInt64(&c.buffered))
 }
 
-func (c conn) GetServerPublicKey() *[32]byte {
+// Only called with readLock held, BufferedBytes reads the length without it
+func (c *conn) setBuffer(b []byte) {
+	c.buffer = b
+	atomic.StoreInt64(&c.buffered, int64(len(b)))
+}
+
+// This may be called concurrently with reads and writes
+func (c *conn) Stats() (stats Stats) {
+	stats.BytesSent = atomic.LoadUint64(&c.stats.BytesSent)
+	stats.BytesReceived = atomic.LoadUint64(&c.stats.BytesReceived)
+	stats.FramesSent = atomic.LoadUint64(&c.stats.FramesSent)
+	stats.FramesReceived = atomic.LoadUint64(&c.stats.FramesReceived)
+	stats.DataFramesReceived = atomic.LoadUint64(&c.stats.DataFramesReceived)
+	stats.DecryptFailures = atomic.LoadUint64(&c.stats.DecryptFailures)
+	stats.Rekeys = atomic.LoadUint64(&c.stats.Rekeys)
+	return
+}
+
+// Empty until the handshake completed
+func (c *conn) GetPeerFingerprint() string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	peer := c.peerPublicKey()
+	if peer == nil {
+		return ""
+	}
+	return Fingerprint(peer)
+}
+
+func (c *conn) peerPublicKey() *[32]byte {
+	if c.isServer {
+		return c.PublicKey
+	}
 	return c.ServerPublicKey
 }
 
-func (c conn) ReadByte() (b byte, err error) {
-	if !c.isUnread {
-		c.lastRead = make([]byte, 1)
-		_, err = c.Read(c.lastRead)
+// Frames without data are skipped until a byte arrives
+func (c *conn) ReadByte() (b byte, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.canUnread = false
+	var n int
+	for n == 0 && err == nil {
+		n, err = c.read(c.lastRead)
+	}
+	if err != nil {
+		return
 	}
 	b = c.lastRead[0]
-	c.isUnread = false
+	c.canUnread = true
+	return
+}
+
+// The byte goes back in front of the buffered plaintext, so any read returns it next.
+// Only the byte of the last read may be unread, and only if it came from ReadByte
+func (c *conn) UnreadByte() (err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if !c.canUnread {
+		return ErrInvalidUnreadByte
+	}
+	c.canUnread = false
+	c.setBuffer(append([]byte{c.lastRead[0]}, c.buffer...))
+	return
+}
+
+func (c *conn) Read(b []byte) (n int, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.canUnread = false
+	return c.read(b)
+}
+
+// Plaintext left over from an earlier frame is returned without touching the
+// underlying connection, so it is returned even after the read deadline passed.
+// Only reads that need a new frame fail with the deadline's timeout
+func (c *conn) read(b []byte) (n int, err error) {
+	if len(c.buffer) > 0 {
+		n = copy(b, c.buffer)
+		c.setBuffer(c.buffer[n:])
+		return
+	}
+	decrypted, err := c.readFrame()
+	if err != nil {
+		return
+	}
+	n = copy(b, decrypted)
+	c.setBuffer(decrypted[n:])
 	return
 }
 
-func (c conn) UnreadByte() (err error) {
-	c.isUnread = true
+// This reads exactly n bytes across as many frames as needed, concurrent readers
+// wait until it returns. The stream ending first returns what was read with
+// io.ErrUnexpectedEOF, or io.EOF if nothing was. An n below one reads nothing
+func (c *conn) ReadN(n int) (b []byte, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	if n < 1 {
+		return []byte{}, nil
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.canUnread = false
+	b = make([]byte, n)
+	read := 0
+	for read < n && err == nil {
+		var m int
+		m, err = c.read(b[read:])
+		read += m
+	}
+	if read == n {
+		err = nil
+	} else if read > 0 && err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b[:read], err
+}
+
+// Empty writes return (0, nil) without sending anything, since an empty frame is
+// what CloseWrite sends to mark the end of the stream.
+// With Config.WriteBufferSize set, small writes are only sent once the buffer
+// fills up or on Flush, writes that fill it on their own are sent right away
+func (c *conn) Write(b []byte) (n int, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.writeBufferSize == 0 {
+		return c.writeChunks(b)
+	}
+	if !c.handshakeComplete {
+		return 0, ErrNotHandshaked
+	}
+	if c.writeClosed {
+		return 0, ErrWriteClosed
+	}
+	if c.isClosed() {
+		return 0, ErrClosed
+	}
+	for len(b) > 0 {
+		if len(c.pendingWrite) == 0 && len(b) >= int(c.writeBufferSize) {
+			var written int
+			written, err = c.writeChunks(b)
+			n += written
+			return
+		}
+		take := int(c.writeBufferSize) - len(c.pendingWrite)
+		if take > len(b) {
+			take = len(b)
+		}
+		c.pendingWrite = append(c.pendingWrite, b[:take]...)
+		n += take
+		b = b[take:]
+		if len(c.pendingWrite) == int(c.writeBufferSize) {
+			err = c.flush()
+			if err != nil {
+				return
+			}
+		}
+	}
 	return
 }
 
-func (c conn) Read(b []byte) (n int, err error) {
-	copied := copy(b, c.buffer)
-	newBuf := make([]byte, len(c.buffer)-copied)
-	c.buffer = newBuf
-	if copied < len(b) {
-		n, err = c.unbufferedRead(b[copied:])
+func (c *conn) writeChunks(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > int(c.chunkSize) {
+			chunk = chunk[:c.chunkSize]
+		}
+		err = c.writeFrame(chunk)
 		if err != nil {
 			return
 		}
+		n += len(chunk)
+		b = b[len(chunk):]
 	}
 	return
 }
 
-func (c conn) unbufferedRead(b []byte) (n int, err error) {
-	var nonce [24]byte
-	n, err = io.ReadFull(c.bufferedRead, nonce[:])
+// This sends what Write buffered as one frame
+func (c *conn) Flush() (err error) {
+	err = c.handshakeFirst(context.Background())
 	if err != nil {
 		return
 	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.flush()
+}
 
-	header := make([]byte, box.Overhead+4) // length: box overhead + len(uint32)
-	n, err = io.ReadFull(c.bufferedRead, header)
+// Every other write flushes first, so buffered bytes are never overtaken
+func (c *conn) flush() (err error) {
+	if len(c.pendingWrite) == 0 {
+		return
+	}
+	err = c.writeFrame(c.pendingWrite)
 	if err != nil {
 		return
 	}
+	wipe(c.pendingWrite)
+	c.pendingWrite = c.pendingWrite[:0]
+	return
+}
 
-	lengthCode, success := box.OpenAfterPrecomputation([]byte{}, header, &nonce, c.sharedKey)
-	if !success {
-		err = errors.New("OpenAfterPrecomputation failed on header")
+// Each chunk read from r is sealed directly into its own frame
+func (c *conn) ReadFrom(r io.Reader) (n int64, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
 		return
 	}
-	length := binary.LittleEndian.Uint32(lengthCode)
-
-	n, err = io.ReadFull(c.bufferedRead, nonce[:])
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	err = c.flush()
 	if err != nil {
 		return
 	}
+	chunk := make([]byte, c.chunkSize)
+	for {
+		read, rerr := r.Read(chunk)
+		if read > 0 {
+			err = c.writeFrame(chunk[:read])
+			if err != nil {
+				return
+			}
+			n += int64(read)
+		}
+		if rerr == io.EOF {
+			return
+		}
+		if rerr != nil {
+			err = rerr
+			return
+		}
+	}
+}
 
-	data := make([]byte, length)
-	n, err = io.ReadFull(c.bufferedRead, data)
+// Each decrypted frame is written to w as it arrives, until the peer closes the connection
+func (c *conn) WriteTo(w io.Writer) (n int64, err error) {
+	err = c.handshakeFirst(context.Background())
 	if err != nil {
 		return
 	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.canUnread = false
+	decrypted := c.buffer
+	c.setBuffer(nil)
+	for {
+		if len(decrypted) > 0 {
+			var written int
+			written, err = w.Write(decrypted)
+			n += int64(written)
+			if err != nil {
+				return
+			}
+			if written != len(decrypted) {
+				err = io.ErrShortWrite
+				return
+			}
+		}
+		decrypted, err = c.readFrame()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
 
-	decrypted, success := box.OpenAfterPrecomputation([]byte{}, data, &nonce, c.sharedKey)
-	if !success {
-		err = errors.New("OpenAfterPrecomputation failed on data")
+// This sends r in frames of up to Config.ChunkSize bytes and then calls CloseWrite,
+// so the peer's RecvStream returns once it wrote everything. Writes block while
+// the underlying connection does, so r is only read as fast as the peer keeps up
+func (c *conn) SendStream(r io.Reader) (err error) {
+	_, err = c.ReadFrom(r)
+	if err != nil {
 		return
 	}
+	return c.CloseWrite()
+}
 
-	copied := copy(b, decrypted)
+// This writes everything the peer sends to w until its SendStream or CloseWrite
+func (c *conn) RecvStream(w io.Writer) (err error) {
+	_, err = c.WriteTo(w)
+	return
+}
 
-	if copied < len(decrypted) {
-		c.buffer = make([]byte, len(decrypted)-copied)
-		copied += copy(c.buffer, decrypted[copied:])
-		if copied != len(decrypted) {
-			err = errors.New("Copied wrong amount of bytes")
-		}
+// Plaintext left over from a partial Read is returned as the rest of its message
+func (c *conn) ReadMessage() (b []byte, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.canUnread = false
+	if len(c.buffer) > 0 {
+		b = append([]byte{}, c.buffer...)
+		c.setBuffer(nil)
+		return
+	}
+	decrypted, err := c.readFrame()
+	if err != nil {
+		return
 	}
+	b = append([]byte{}, decrypted...)
+	return
+}
 
+// Like ReadMessage without allocating, a frame whose plaintext fits in b is
+// opened straight into it. A message longer than b fails with io.ErrShortBuffer
+// and stays buffered for the next read
+func (c *conn) ReadMessageInto(b []byte) (n int, err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.canUnread = false
+	if len(c.buffer) == 0 {
+		c.openInto = b
+		var decrypted []byte
+		decrypted, err = c.readFrame()
+		c.openInto = nil
+		if err != nil {
+			return
+		}
+		// Padded frames start their payload 4 bytes into b
+		if len(decrypted) <= len(b) {
+			return copy(b, decrypted), nil
+		}
+		c.setBuffer(decrypted)
+	}
+	if len(c.buffer) > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	n = copy(b, c.buffer)
+	c.setBuffer(nil)
 	return
 }
 
-func (c conn) Write(b []byte) (n int, err error) {
-	var writebuf []byte
-	outLen := len(b) + box.Overhead
-	var nonce [24]byte
-	n, err = rand.Read(nonce[:])
+// The message is sent as exactly one frame. Empty messages fail with
+// ErrEmptyMessage, as the empty frame marks the end of the stream, and
+// messages beyond Config.MaxFrameSize fail with ErrFrameTooLarge.
+// This is the only write that is compressed when Config.Compression is set
+func (c *conn) WriteMessage(b []byte) (err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if len(b) == 0 {
+		return ErrEmptyMessage
+	}
+	if uint64(len(b)) > uint64(c.maxFrameSize) {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(b))
+	}
+	err = c.flush()
+	if err != nil {
+		return
+	}
+	err = c.announceCompression()
+	if err != nil {
+		return
+	}
+	frameType, body, err := c.compress(b)
 	if err != nil {
 		return
 	}
-	writebuf = append(writebuf, nonce[:]...)
+	return c.writeFrameType(frameType, body, len(b))
+}
+
+// The message is returned as a string, without checking that it is valid UTF-8
+func (c *conn) ReadString() (s string, err error) {
+	b, err := c.ReadMessage()
+	return string(b), err
+}
 
-	length := make([]byte, 4)
-	lengthIn := uint32(outLen)
-	binary.LittleEndian.PutUint32(length, lengthIn)
-	writebuf = append(writebuf, box.SealAfterPrecomputation([]byte{}, length, &nonce, c.sharedKey)...)
+// This writes s as one message, copied through a pooled buffer that is wiped
+// afterwards. Unlike io.StringWriter, only the error is returned
+func (c *conn) WriteString(s string) (err error) {
+	pooled := getBuffer(len(s))
+	defer putBuffer(pooled)
+	b := (*pooled)[:copy(*pooled, s)]
+	defer wipe(b)
+	return c.WriteMessage(b)
+}
+
+// The underlying connection is closed first to unblock pending reads and writes,
+// then key material and buffered plaintext are wiped. From version 5 on, or with
+// Config.WriteBufferSize set, this first gives pending writes closeTimeout to
+// finish, flushes what Write buffered and sends the close frame
+func (c *conn) Close() (err error) {
+	c.stateLock.RLock()
+	unwrapped := c.unwrapped
+	c.stateLock.RUnlock()
+	if unwrapped {
+		return ErrClosed
+	}
+	var flushErr error
+	if c.closing() {
+		c.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeLock.Lock()
+		if !c.writeClosed {
+			flushErr = c.flush()
+			if flushErr == nil && c.version >= Version5 {
+				flushErr = c.writeRawFrame(frameClose, nil)
+			}
+		}
+		c.writeLock.Unlock()
+	}
+	c.closeOnce.Do(func() { close(c.done) })
+	err = c.Conn.Close()
+	if err == nil {
+		err = flushErr
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.wipeSecrets()
+	return
+}
+
+// Callers hold readLock and writeLock
+func (c *conn) wipeSecrets() {
+	wipeKey(c.privateKey)
+	wipeKey(c.sharedKey)
+	wipeKey(c.sendKey)
+	wipeKey(c.recvKey)
+	wipeKey(c.resumptionSecret)
+	c.sealer, c.opener = keyedAEAD{}, keyedAEAD{}
+	wipe(c.plaintext[:cap(c.plaintext)])
+	wipe(c.decompressed[:cap(c.decompressed)])
+	wipe(c.lastRead)
+	wipe(c.pendingWrite)
+}
+
+// This ends the session without telling the peer and hands back the underlying
+// connection, which Close no longer closes. What Write buffered is flushed
+// first, an error doing so is returned once the connection is unwrapped all the
+// same. Plaintext opened but not yet read is returned, and so are the raw bytes
+// read from the connection but not yet opened as a frame, so whatever the peer
+// sent after its last frame is not lost. This waits for pending reads and
+// writes, wipes the keys, and every later call returns ErrClosed
+func (c *conn) Unwrap() (oc net.Conn, plaintext, raw []byte, err error) {
+	c.stateLock.Lock()
+	c.unwrapped = true
+	c.stateLock.Unlock()
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if !c.writeClosed && !c.isClosed() {
+		err = c.flush()
+	}
+	c.closeOnce.Do(func() { close(c.done) })
+	c.canUnread = false
+	plaintext = append([]byte{}, c.buffer...)
+	raw = append([]byte{}, c.partial...)
+	rest, _ := c.bufferedRead.Peek(c.bufferedRead.Buffered())
+	raw = append(raw, rest...)
+	c.bufferedRead.Discard(len(rest))
+	c.partial = c.partial[:0]
+	c.setBuffer(nil)
+	c.wipeSecrets()
+	return c.Conn, plaintext, raw, err
+}
+
+// Whether Close has anything to send before closing the underlying connection
+func (c *conn) closing() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.handshakeComplete && (c.writeBufferSize > 0 || c.version >= Version5)
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closes the underlying connection without sending anything, the keys are only
+// wiped by Close
+func (c *conn) fail() {
+	c.closeOnce.Do(func() { close(c.done) })
+	c.Conn.Close()
+}
+
+// This rotates the key for frames we send, the peer follows when it reads the rekey frame.
+// After a Noise handshake this fails with ErrNoiseTransport
+func (c *conn) Rekey() (err error) {
+	err = c.handshakeFirst(context.Background())
 	if err != nil {
 		return
 	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.rekey()
+}
 
-	n, err = rand.Read(nonce[:])
+// This sends an empty frame the peer reads as io.EOF, then half-closes the
+// underlying connection if it supports CloseWrite. Otherwise the underlying
+// connection stays open and only further writes on this Conn are refused
+func (c *conn) CloseWrite() (err error) {
+	err = c.handshakeFirst(context.Background())
+	if err != nil {
+		return
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	err = c.flush()
 	if err != nil {
 		return
 	}
-	writebuf = append(writebuf, nonce[:]...)
+	err = c.writeRawFrame(frameData, nil)
 	if err != nil {
 		return
 	}
+	c.writeClosed = true
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		err = cw.CloseWrite()
+	}
+	return
+}
 
-	writebuf = append(writebuf, box.SealAfterPrecomputation([]byte{}, b, &nonce, c.sharedKey)...)
-	return c.Conn.Write(writebuf)
+// This sets the operating system's receive buffer of the underlying connection,
+// ErrUnsupported unless it has a SetReadBuffer method like *net.TCPConn
+func (c *conn) SetReadBuffer(bytes int) error {
+	if rb, ok := c.Conn.(interface{ SetReadBuffer(int) error }); ok {
+		return rb.SetReadBuffer(bytes)
+	}
+	return ErrUnsupported
+}
+
+// This sets the operating system's send buffer of the underlying connection,
+// ErrUnsupported unless it has a SetWriteBuffer method like *net.TCPConn
+func (c *conn) SetWriteBuffer(bytes int) error {
+	if wb, ok := c.Conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return wb.SetWriteBuffer(bytes)
+	}
+	return ErrUnsupported
 }
 
+// About half of all private keys have a representative, so running out of
+// attempts means the source of randomness is broken
+const maxKeygenAttempts = 128
+
 func GenerateKeys() (pub, priv, elligator [32]byte, err error) {
-	for {
-		_, err = io.ReadFull(rand.Reader, priv[:])
+	return GenerateKeysContext(context.Background())
+}
+
+// The context is checked before each attempt, a read from crypto/rand that
+// blocks is not interrupted
+func GenerateKeysContext(ctx context.Context) (pub, priv, elligator [32]byte, err error) {
+	return generateKeys(ctx, rand.Reader)
+}
+
+// The private key is drawn from r instead of crypto/rand
+func GenerateKeysWithRand(r io.Reader) (pub, priv, elligator [32]byte, err error) {
+	return generateKeys(context.Background(), r)
+}
+
+func generateKeys(ctx context.Context, r io.Reader) (pub, priv, elligator [32]byte, err error) {
+	for i := 0; i < maxKeygenAttempts; i++ {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(r, priv[:])
 		if err != nil {
 			return
 		}
 		if extra25519.ScalarBaseMult(&pub, &elligator, &priv) {
-			break
+			return
 		}
 	}
+	wipe(priv[:])
+	err = ErrKeygenExhausted
 	return
 }
 
-// This generates a keypair for the connection
+// This generates a keypair for the connection, acting as the client
 func Wrap(oc net.Conn) (nc Conn, err error) {
-	pub, priv, elligator, err := GenerateKeys()
+	return Client(oc, nil)
+}
+
+// This generates a keypair for the connection and requires the server to present the expected key
+func WrapWithServerKey(oc net.Conn, expected [32]byte) (nc Conn, err error) {
+	return Client(oc, &Config{ServerPublicKey: &expected})
+}
+
+// The initiating side of the connection, using the keypair from config
+func Client(oc net.Conn, config *Config) (nc Conn, err error) {
+	return wrapConfig(context.Background(), oc, false, config)
+}
+
+// The accepting side of the connection, using the keypair from config
+func Server(oc net.Conn, config *Config) (nc Conn, err error) {
+	return wrapConfig(context.Background(), oc, true, config)
+}
+
+// Like Client, for an oc that was already read through r. The handshake and all
+// later reads go through r, so nothing r buffered is lost: the handshake takes
+// exactly its own messages from it and leaves the rest for the first frames.
+// Nothing else may read from r afterwards. Writes go straight to oc, so flush any
+// writer wrapping it first. Config.ReadBufferSize has no effect
+func ClientWithReader(oc net.Conn, r *bufio.Reader, config *Config) (nc Conn, err error) {
+	return wrapReader(oc, r, false, config)
+}
+
+// The accepting side of ClientWithReader
+func ServerWithReader(oc net.Conn, r *bufio.Reader, config *Config) (nc Conn, err error) {
+	return wrapReader(oc, r, true, config)
+}
+
+func wrapReader(oc net.Conn, r *bufio.Reader, server bool, config *Config) (nc Conn, err error) {
+	pub, priv, elligator, err := config.keys()
+	if err != nil {
+		return
+	}
+	c := newConn(oc, pub, priv, elligator, server, config)
+	c.bufferedRead = r
+	err = c.Handshake(context.Background())
 	if err != nil {
 		return
 	}
-	return WrapWithKeys(oc, pub, priv, elligator)
+	nc = c
+	return
 }
 
-// This allows reusing a previously generated keypair for the connection
-func WrapWithKeys(oc net.Conn, pub, priv, elligator [32]byte) (nc Conn, err error) {
-	_, err = oc.Write(elligator[:])
+func wrapConfig(ctx context.Context, oc net.Conn, server bool, config *Config) (nc Conn, err error) {
+	pub, priv, elligator, err := config.keys()
 	if err != nil {
 		return
 	}
+	return wrap(ctx, oc, pub, priv, elligator, server, config)
+}
 
-	bRead := bufio.NewReader(oc)
-	var serverKeyElligator [32]byte
-	_, err = io.ReadFull(bRead, serverKeyElligator[:])
+// This allows reusing a previously generated keypair for the connection, acting as the client
+func WrapWithKeys(oc net.Conn, pub, priv, elligator [32]byte) (nc Conn, err error) {
+	return WrapClient(oc, pub, priv, elligator)
+}
+
+// The initiating side of the connection must call WrapClient,
+// it writes its representative first and then reads the server's
+func WrapClient(oc net.Conn, pub, priv, elligator [32]byte) (nc Conn, err error) {
+	return WrapClientWithConfig(oc, pub, priv, elligator, nil)
+}
+
+// The accepting side of the connection must call WrapServer,
+// it reads the client's representative first and then writes its own
+func WrapServer(oc net.Conn, pub, priv, elligator [32]byte) (nc Conn, err error) {
+	return WrapServerWithConfig(oc, pub, priv, elligator, nil)
+}
+
+// The server-side counterpart of WrapWithKeys for connections from an own Accept loop,
+// the public key is derived from priv and elligator must be its representative
+func WrapAccepted(oc net.Conn, priv, elligator [32]byte) (nc Conn, err error) {
+	return wrapConfig(context.Background(), oc, true, &Config{PrivateKey: &priv, Representative: &elligator})
+}
+
+// This skips the handshake, both ends derive their keys from shared, which must be
+// unique to this connection: frame nonces are derived from it too, so a second
+// connection under the same key repeats the nonces of the first. The initiating
+// side calls WrapWithSharedKey and the accepting side WrapServerWithSharedKey,
+// and both public keys of the connection read as zero
+func WrapWithSharedKey(oc net.Conn, shared [32]byte) (nc Conn, err error) {
+	return wrapSharedKey(oc, shared, false)
+}
+
+// The accepting side of WrapWithSharedKey
+func WrapServerWithSharedKey(oc net.Conn, shared [32]byte) (nc Conn, err error) {
+	return wrapSharedKey(oc, shared, true)
+}
+
+func wrapSharedKey(oc net.Conn, shared [32]byte, server bool) (nc Conn, err error) {
+	if !isStream(oc) {
+		return nil, ErrUnsupportedTransport
+	}
+	var zero [32]byte
+	c := newConn(oc, zero, zero, zero, server, nil)
+	err = c.establish(mixKeys("securenet shared key", &shared), &zero, maxVersion, NaClBox, nil)
 	if err != nil {
 		return
 	}
+	nc = c
+	return
+}
+
+// A nil config uses the defaults
+func WrapClientWithConfig(oc net.Conn, pub, priv, elligator [32]byte, config *Config) (nc Conn, err error) {
+	return wrap(context.Background(), oc, pub, priv, elligator, false, config)
+}
+
+// A nil config uses the defaults
+func WrapServerWithConfig(oc net.Conn, pub, priv, elligator [32]byte, config *Config) (nc Conn, err error) {
+	return wrap(context.Background(), oc, pub, priv, elligator, true, config)
+}
+
+// Reads and writes fail with ErrNotHandshaked until Handshake is called
+func NewClientConn(oc net.Conn, pub, priv, elligator [32]byte, config *Config) Conn {
+	return newConn(oc, pub, priv, elligator, false, config)
+}
 
-	var serverKey [32]byte
-	extra25519.RepresentativeToPublicKey(&serverKey, &serverKeyElligator)
+// Reads and writes fail with ErrNotHandshaked until Handshake is called
+func NewServerConn(oc net.Conn, pub, priv, elligator [32]byte, config *Config) Conn {
+	return newConn(oc, pub, priv, elligator, true, config)
+}
 
-	var shared [32]byte
-	box.Precompute(&shared, &serverKey, &priv)
+// Keys are only set once the handshake completed
+func copyKey(key *[32]byte) *[32]byte {
+	if key == nil {
+		return nil
+	}
+	copied := *key
+	return &copied
+}
 
-	nc = conn{
-		Conn:            oc,
-		bufferedRead:    bRead,
-		lastRead:        make([]byte, 1),
-		isUnread:        false,
-		privateKey:      &priv,
-		PublicKey:       &pub,
-		ServerPublicKey: &serverKey,
-		sharedKey:       &shared,
+func wipeKey(key *[32]byte) {
+	if key != nil {
+		wipe(key[:])
 	}
-	return
+}
+
+// KeepAlive keeps the stores from being optimized away as dead
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
 }
@@ -0,0 +1,1146 @@
+package securenet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Both ends of a TCP connection over loopback, which unlike net.Pipe buffers
+// writes, so both ends may close at once
+func tcpPair(t testing.TB) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	return
+}
+
+// Both ends of a handshaked connection
+func testConns(t testing.TB, clientConfig, serverConfig *Config) (client, server Conn) {
+	t.Helper()
+	a, b := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = Server(b, serverConfig)
+		done <- err
+	}()
+	client, err := Client(a, clientConfig)
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		a.Close()
+		b.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+// Over net.Pipe, where writes block until the peer reads them
+func pipeConns(t *testing.T, clientConfig, serverConfig *Config) (client, server Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = Server(b, serverConfig)
+		done <- err
+	}()
+	client, err := Client(a, clientConfig)
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return
+}
+
+func testKeys(t testing.TB) *Config {
+	t.Helper()
+	_, priv, elligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{PrivateKey: &priv, Representative: &elligator}
+}
+
+// Keeps a copy of everything written to the connection, and only that copy
+// while held
+type recordingConn struct {
+	net.Conn
+	lock    sync.Mutex
+	written bytes.Buffer
+	held    bool
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	c.written.Write(b)
+	held := c.held
+	c.lock.Unlock()
+	if held {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) hold() {
+	c.lock.Lock()
+	c.held = true
+	c.lock.Unlock()
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]byte{}, c.written.Bytes()...)
+}
+
+// Handshaked ends whose client records what it writes, recorded.Conn writes to
+// the server past the client
+func recordedConns(t testing.TB, clientConfig, serverConfig *Config) (client, server Conn, recorded *recordingConn) {
+	t.Helper()
+	a, b := tcpPair(t)
+	recorded = &recordingConn{Conn: a}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = Server(b, serverConfig)
+		done <- err
+	}()
+	client, err := Client(recorded, clientConfig)
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		a.Close()
+		b.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+var testAEADs = []struct {
+	name string
+	aead AEAD
+}{
+	{"NaClBox", NaClBox},
+	{"XChaCha20Poly1305", XChaCha20Poly1305},
+	{"AESGCM", AESGCM},
+}
+
+// The net.Conn and io.ByteScanner contract over an in-memory pipe, after the
+// cases of golang.org/x/net/nettest.TestConn, for every version and the AEADs
+// servers may pick from version 4 on
+func TestConnConformance(t *testing.T) {
+	for version := uint8(minVersion); version <= maxVersion; version++ {
+		for _, a := range testAEADs {
+			if version < Version4 && a.aead != NaClBox {
+				continue
+			}
+			version, a := version, a
+			t.Run(fmt.Sprintf("Version%d/%s", version, a.name), func(t *testing.T) {
+				testConformance(t, &Config{MaxVersion: version}, &Config{ChunkSize: 1000, MaxVersion: version, AEAD: a.aead})
+			})
+		}
+	}
+}
+
+func testConformance(t *testing.T, clientConfig, serverConfig *Config) {
+	for _, tc := range []struct {
+		name string
+		test func(t *testing.T, client, server Conn)
+	}{
+		{"BasicIO", testBasicIO},
+		{"ConcurrentIO", testConcurrentIO},
+		{"Close", testClose},
+		{"PastReadDeadline", testPastReadDeadline},
+		{"ReadDeadlineUnblocks", testReadDeadlineUnblocks},
+		{"WriteDeadline", testWriteDeadline},
+		{"Addresses", testAddresses},
+		{"ByteScanner", testByteScanner},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := pipeConns(t, clientConfig, serverConfig)
+			state := client.ConnectionState()
+			if state.Version != serverConfig.maxVersion() || state.AEAD != serverConfig.aead().ID() && state.Version >= Version4 {
+				t.Fatal("version", state.Version, "AEAD", state.AEAD)
+			}
+			tc.test(t, client, server)
+		})
+	}
+}
+
+// A client with Config.AEAD set takes no other
+func TestClientAEADMismatch(t *testing.T) {
+	a, b := tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+	go Server(b, &Config{AEAD: XChaCha20Poly1305})
+	if _, err := Client(a, &Config{AEAD: AESGCM}); !errors.Is(err, ErrUnsupportedAEAD) {
+		t.Fatal(err)
+	}
+}
+
+func randomBytes(t testing.TB, n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testBasicIO(t *testing.T, client, server Conn) {
+	want := randomBytes(t, 1<<16)
+	go func() {
+		// Uneven writes, each split into frames of ChunkSize
+		for rest := want; len(rest) > 0; {
+			n := 1 + len(rest)%3001
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := server.Write(rest[:n]); err != nil {
+				t.Error(err)
+				return
+			}
+			rest = rest[n:]
+		}
+		server.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("bytes came back changed")
+	}
+}
+
+func testConcurrentIO(t *testing.T, client, server Conn) {
+	want := randomBytes(t, 1<<15)
+	errs := make(chan error, 4)
+	echo := func(c Conn) {
+		got := make([]byte, len(want))
+		_, err := io.ReadFull(c, got)
+		if err == nil && !bytes.Equal(got, want) {
+			err = errors.New("bytes came back changed")
+		}
+		errs <- err
+	}
+	send := func(c Conn) {
+		_, err := c.Write(want)
+		errs <- err
+	}
+	go echo(client)
+	go echo(server)
+	go send(client)
+	go send(server)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testClose(t *testing.T, client, server Conn) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		done <- err
+	}()
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != io.EOF {
+		t.Fatal("peer read", err)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("write after Close succeeded")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read after Close succeeded")
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func testPastReadDeadline(t *testing.T, client, server Conn) {
+	client.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := client.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatal(err)
+	}
+	// A timed out read leaves the connection usable
+	client.SetReadDeadline(time.Time{})
+	go server.Write([]byte("after"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(client, b); err != nil || string(b) != "after" {
+		t.Fatal(string(b), err)
+	}
+}
+
+func testReadDeadlineUnblocks(t *testing.T, client, server Conn) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client.SetReadDeadline(time.Now())
+	select {
+	case err := <-done:
+		if !isTimeout(err) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("setting a deadline did not unblock the pending read")
+	}
+}
+
+func testWriteDeadline(t *testing.T, client, server Conn) {
+	client.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	// Nobody reads on the other end of the pipe
+	if _, err := client.Write([]byte("blocked")); !isTimeout(err) {
+		t.Fatal(err)
+	}
+}
+
+func testAddresses(t *testing.T, client, server Conn) {
+	if client.LocalAddr() == nil || client.RemoteAddr() == nil || server.LocalAddr() == nil || server.RemoteAddr() == nil {
+		t.Fatal("missing address")
+	}
+	if client.LocalAddr().Network() != "pipe" || client.LocalAddr().String() != server.RemoteAddr().String() {
+		t.Fatal(client.LocalAddr(), server.RemoteAddr())
+	}
+}
+
+func testByteScanner(t *testing.T, client, server Conn) {
+	want := []byte("across several frames")
+	go func() {
+		for i := range want {
+			server.Write(want[i : i+1])
+		}
+	}()
+	var got []byte
+	for len(got) < len(want) {
+		b, err := client.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = client.UnreadByte(); err != nil {
+			t.Fatal(err)
+		}
+		if err = client.UnreadByte(); err != ErrInvalidUnreadByte {
+			t.Fatal("second UnreadByte", err)
+		}
+		again, err := client.ReadByte()
+		if err != nil || again != b {
+			t.Fatal("the unread byte came back as", again, err)
+		}
+		got = append(got, b)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal(string(got))
+	}
+}
+
+// Hide ReadFrom and WriteTo from io.Copy
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func benchmarkCopy(b *testing.B, direct bool) {
+	client, server := testConns(b, nil, nil)
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		if direct {
+			_, err = io.Copy(ioutil.Discard, server)
+		} else {
+			_, err = io.Copy(onlyWriter{ioutil.Discard}, onlyReader{server})
+		}
+		done <- err
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if direct {
+			_, err = io.Copy(client, bytes.NewReader(data))
+		} else {
+			_, err = io.Copy(onlyWriter{client}, onlyReader{bytes.NewReader(data)})
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.CloseWrite()
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// Through ReadFrom and WriteTo
+func BenchmarkCopyDirect(b *testing.B) { benchmarkCopy(b, true) }
+
+// Through Read and Write
+func BenchmarkCopyReadWrite(b *testing.B) { benchmarkCopy(b, false) }
+
+func TestSmallReads(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	want := randomBytes(t, 100000)
+	go client.Write(want)
+	got := make([]byte, 0, len(want))
+	chunk := make([]byte, 7)
+	for len(got) < len(want) {
+		n, err := server.Read(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, chunk[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("bytes arrived out of order")
+	}
+}
+
+// Reads served partly from the plaintext of an earlier frame and partly from a
+// new one count every byte they return
+func TestReadCount(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	go func() {
+		client.Write([]byte("abc"))
+		client.Write([]byte("defgh"))
+		client.CloseWrite()
+	}()
+	b := make([]byte, 2)
+	if n, err := server.Read(b); n != 2 || err != nil || string(b) != "ab" {
+		t.Fatal(n, err, string(b))
+	}
+	var got []byte
+	for {
+		b := bytes.Repeat([]byte{'-'}, 10)
+		n, err := server.Read(b)
+		if bytes.IndexByte(b[:n], '-') >= 0 || b[n] != '-' {
+			t.Fatalf("read returned %d for %q", n, b)
+		}
+		got = append(got, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(got) != "cdefgh" {
+		t.Fatal(string(got))
+	}
+}
+
+// Accepts at most a few bytes per write, or none at all when stuck
+type shortWriteConn struct {
+	net.Conn
+	stuck bool
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	if c.stuck {
+		return 0, nil
+	}
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	return c.Conn.Write(b)
+}
+
+func TestShortWrites(t *testing.T) {
+	a, b := tcpPair(t)
+	short := &shortWriteConn{Conn: a}
+	done := make(chan error, 1)
+	var server Conn
+	go func() {
+		var err error
+		server, err = Server(b, nil)
+		done <- err
+	}()
+	client, err := Client(short, nil)
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	want := randomBytes(t, 10000)
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write(want)
+		written <- err
+	}()
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(server, got); err != nil || !bytes.Equal(got, want) {
+		t.Fatal(err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	short.stuck = true
+	if _, err = client.Write([]byte("stuck")); err != io.ErrShortWrite {
+		t.Fatal(err)
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	want := randomBytes(t, 5<<20)
+	written := make(chan error, 1)
+	go func() {
+		n, err := client.Write(want)
+		if err == nil && n != len(want) {
+			err = io.ErrShortWrite
+		}
+		if err == nil {
+			err = client.CloseWrite()
+		}
+		written <- err
+	}()
+	got, err := ioutil.ReadAll(server)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatal(len(got), err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+	if frames := server.Stats().DataFramesReceived; frames < uint64(len(want)/DefaultChunkSize) {
+		t.Fatalf("%d bytes arrived in %d frames", len(want), frames)
+	}
+}
+
+func TestCloseWipesSecrets(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	go client.Write([]byte("left over"))
+	if _, err := server.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	s := server.(*conn)
+	buffered := s.buffer
+	if string(buffered) != " over" {
+		t.Fatal(string(buffered))
+	}
+	keys := []*[32]byte{s.privateKey, s.sharedKey, s.sendKey, s.recvKey}
+	server.Close()
+	for i, key := range keys {
+		if *key != [32]byte{} {
+			t.Fatal("key", i, "was not wiped")
+		}
+	}
+	if !bytes.Equal(buffered, make([]byte, len(buffered))) {
+		t.Fatal("buffered plaintext was not wiped")
+	}
+}
+
+// Buffered plaintext is returned after the read deadline passed, only reading
+// the socket times out
+func TestDeadlineWithBufferedPlaintext(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	if _, err := client.Write([]byte("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "abc" {
+		t.Fatal(string(b), err)
+	}
+	server.SetReadDeadline(time.Now().Add(-time.Second))
+	if got, err := server.ReadN(6); string(got) != "def" || !isTimeout(err) {
+		t.Fatal(string(got), err)
+	}
+	if n, err := server.Read(b); n != 0 || !isTimeout(err) {
+		t.Fatal(n, err)
+	}
+
+	server.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte("ghi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "ghi" {
+		t.Fatal(string(b), err)
+	}
+}
+
+func TestScanAcrossFrames(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	go func() {
+		for _, frame := range []string{"fir", "st\nsec", "ond\n", "third"} {
+			client.Write([]byte(frame))
+		}
+		client.CloseWrite()
+	}()
+
+	// The last byte of a frame unread comes back before the next frame
+	for _, want := range []byte("first") {
+		b, err := server.ReadByte()
+		if err != nil || b != want {
+			t.Fatal(b, err)
+		}
+	}
+	if err := server.UnreadByte(); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 1)
+	if _, err := io.ReadFull(server, got); err != nil || got[0] != 't' {
+		t.Fatal(string(got), err)
+	}
+
+	scanner := bufio.NewScanner(server)
+	scanner.Split(bufio.ScanBytes)
+	var rest []byte
+	for scanner.Scan() {
+		rest = append(rest, scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "\nsecond\nthird" {
+		t.Fatalf("%q", rest)
+	}
+}
+
+func TestConnAddr(t *testing.T) {
+	a, b := tcpPair(t)
+	done := make(chan Conn, 1)
+	go func() {
+		server, _ := Server(b, nil)
+		done <- server
+	}()
+	client, err := Client(a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-done
+	if server == nil {
+		t.Fatal("handshake failed")
+	}
+	defer server.Close()
+	if client.LocalAddr() != a.LocalAddr() || client.RemoteAddr() != a.RemoteAddr() || server.LocalAddr() != b.LocalAddr() || server.RemoteAddr() != b.RemoteAddr() {
+		t.Fatal(client.LocalAddr(), client.RemoteAddr(), server.LocalAddr(), server.RemoteAddr())
+	}
+}
+
+// Empty writes send nothing, so the peer never mistakes them for CloseWrite
+func TestEmptyWrite(t *testing.T) {
+	for _, config := range []*Config{nil, {WriteBufferSize: 100}} {
+		client, server, recorded := recordedConns(t, config, nil)
+		before := len(recorded.bytes())
+		for _, b := range [][]byte{nil, {}} {
+			if n, err := client.Write(b); n != 0 || err != nil {
+				t.Fatal(n, err)
+			}
+		}
+		if err := client.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if len(recorded.bytes()) != before {
+			t.Fatal("an empty write reached the wire")
+		}
+		client.Write([]byte("after"))
+		client.Flush()
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(server, b); err != nil || string(b) != "after" {
+			t.Fatal(string(b), err)
+		}
+	}
+}
+
+// Remembers the socket buffer sizes it was given
+type socketBufferConn struct {
+	net.Conn
+	readBuffer, writeBuffer int
+}
+
+func (c *socketBufferConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return nil
+}
+
+func (c *socketBufferConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = bytes
+	return nil
+}
+
+func TestSocketBuffers(t *testing.T) {
+	client, _ := testConns(t, nil, nil)
+	if err := client.SetReadBuffer(1 << 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetWriteBuffer(1 << 16); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := tcpPair(t)
+	defer b.Close()
+	go Server(b, nil)
+	sized := &socketBufferConn{Conn: a}
+	wrapped, err := Client(sized, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrapped.Close()
+	if wrapped.SetReadBuffer(1000) != nil || wrapped.SetWriteBuffer(2000) != nil || sized.readBuffer != 1000 || sized.writeBuffer != 2000 {
+		t.Fatal(sized.readBuffer, sized.writeBuffer)
+	}
+
+	pipeClient, _ := pipeConns(t, nil, nil)
+	if pipeClient.SetReadBuffer(1000) != ErrUnsupported || pipeClient.SetWriteBuffer(1000) != ErrUnsupported {
+		t.Fatal("a pipe has no socket buffers")
+	}
+}
+
+func TestBufferedBytes(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	if _, err := client.Write([]byte("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(server, b); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.BufferedBytes(); n != 4 {
+		t.Fatal(n)
+	}
+	if _, err := server.ReadByte(); err != nil {
+		t.Fatal(err)
+	}
+	server.UnreadByte()
+	if n := server.BufferedBytes(); n != 4 {
+		t.Fatal(n)
+	}
+	if _, err := server.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read waiting for the next frame does not hold it up
+	read := make(chan error, 1)
+	go func() {
+		_, err := server.Read(b)
+		read <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan int, 1)
+	go func() { done <- server.BufferedBytes() }()
+	select {
+	case n := <-done:
+		if n != 0 {
+			t.Fatal(n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BufferedBytes waited for the pending read")
+	}
+	client.Write([]byte("end"))
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	client, server, recorded := recordedConns(t, nil, nil)
+	before := len(recorded.bytes())
+	if err := client.WriteMessage(nil); err != ErrEmptyMessage {
+		t.Fatal(err)
+	}
+	if err := client.WriteString(""); err != ErrEmptyMessage {
+		t.Fatal(err)
+	}
+	if len(recorded.bytes()) != before {
+		t.Fatal("an empty message reached the wire")
+	}
+	go client.WriteMessage([]byte("after"))
+	if m, err := server.ReadMessage(); err != nil || string(m) != "after" {
+		t.Fatal(m, err)
+	}
+}
+
+// Reads n bytes past an unwrapped connection, starting with the raw bytes Unwrap returned
+func readUnwrapped(t *testing.T, oc net.Conn, raw []byte, n int) string {
+	t.Helper()
+	b := make([]byte, n)
+	copied := copy(b, raw)
+	if _, err := io.ReadFull(oc, b[copied:]); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUnwrap(t *testing.T) {
+	client, server, recorded := recordedConns(t, nil, &Config{WriteBufferSize: 100})
+	frame := heldFrame(t, client, recorded, "abcdef")
+	if _, err := recorded.Conn.Write(append(frame, "tail"...)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "ab" {
+		t.Fatal(string(b), err)
+	}
+	if _, err := server.Write([]byte("pending")); err != nil {
+		t.Fatal(err)
+	}
+
+	oc, plaintext, raw, err := server.Unwrap()
+	defer oc.Close()
+	if err != nil || string(plaintext) != "cdef" {
+		t.Fatal(string(plaintext), err)
+	}
+	if got := readUnwrapped(t, oc, raw, 4); got != "tail" {
+		t.Fatal(got)
+	}
+	if _, err = server.Read(b); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if _, err = server.Write(b); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if err = server.Close(); err != ErrClosed {
+		t.Fatal(err)
+	}
+
+	// What Write buffered was flushed, and the unwrapped connection still works
+	if m, err := client.ReadMessage(); err != nil || string(m) != "pending" {
+		t.Fatal(m, err)
+	}
+	if _, err = oc.Write([]byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, plaintext, raw, err := client.Unwrap()
+	defer clientConn.Close()
+	if err != nil || len(plaintext) != 0 {
+		t.Fatal(plaintext, err)
+	}
+	if got := readUnwrapped(t, clientConn, raw, 5); got != "plain" {
+		t.Fatal(got)
+	}
+}
+
+func TestReadMessageInto(t *testing.T) {
+	for _, padding := range []uint32{0, 256} {
+		client, server := testConns(t, &Config{Padding: padding}, nil)
+		want := randomBytes(t, 100000)
+		go client.WriteMessage(want)
+		b := make([]byte, 200000)
+		n, err := server.ReadMessageInto(b)
+		if err != nil || !bytes.Equal(b[:n], want) {
+			t.Fatal(padding, n, err)
+		}
+		// Opened into b, so the internal buffer never grew to the message
+		if size := cap(server.(*conn).plaintext); size >= len(want) {
+			t.Fatal(padding, "plaintext buffer of", size, "bytes")
+		}
+
+		go client.WriteMessage([]byte("too long"))
+		short := make([]byte, 3)
+		if n, err = server.ReadMessageInto(short); err != io.ErrShortBuffer || n != 0 {
+			t.Fatal(padding, n, err)
+		}
+		if server.BufferedBytes() != len("too long") {
+			t.Fatal(padding, server.BufferedBytes())
+		}
+		if n, err = server.ReadMessageInto(b); err != nil || string(b[:n]) != "too long" {
+			t.Fatal(padding, string(b[:n]), err)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	client, server := testConns(t, &Config{ChunkSize: 1000}, nil)
+	want := randomBytes(t, 300000)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.SendStream(bytes.NewReader(want))
+	}()
+	var got bytes.Buffer
+	if err := server.RecvStream(&got); err != nil || !bytes.Equal(got.Bytes(), want) {
+		t.Fatal(got.Len(), err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if frames := server.Stats().DataFramesReceived; frames < uint64(len(want)/1000) {
+		t.Fatal("stream sent in", frames, "frames")
+	}
+}
+
+// A stream cut off without SendStream's close fails instead of ending early
+func TestTruncatedRecvStream(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	go func() {
+		client.Write([]byte("partial"))
+		client.(*conn).Conn.Close()
+	}()
+	var got bytes.Buffer
+	if err := server.RecvStream(&got); err != io.ErrUnexpectedEOF || got.String() != "partial" {
+		t.Fatal(got.String(), err)
+	}
+}
+
+// A message each way between two ends made by any of the constructors
+func testRoundTrip(t *testing.T, client, server Conn) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		m, err := server.ReadMessage()
+		if err == nil {
+			err = server.WriteMessage(append(m, " and back"...))
+		}
+		done <- err
+	}()
+	if err := client.WriteMessage([]byte("there")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := client.ReadMessage(); err != nil || string(m) != "there and back" {
+		t.Fatal(string(m), err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewConn(t *testing.T) {
+	a, b := tcpPair(t)
+	clientPub, clientPriv, clientElligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPub, serverPriv, serverElligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClientConn(a, clientPub, clientPriv, clientElligator, nil)
+	server := NewServerConn(b, serverPub, serverPriv, serverElligator, nil)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	if err = client.WriteMessage([]byte("early")); err != ErrNotHandshaked {
+		t.Fatal(err)
+	}
+	if _, err = server.ReadMessage(); err != ErrNotHandshaked {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Handshake(context.Background())
+	}()
+	if err = client.Handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if *client.GetServerPublicKey() != serverPub || *server.GetPublicKey() != clientPub {
+		t.Fatal("handshake with other keys")
+	}
+	if err = client.Handshake(context.Background()); err != nil {
+		t.Fatal("second Handshake", err)
+	}
+	testRoundTrip(t, client, server)
+}
+
+func TestWrapAccepted(t *testing.T) {
+	pub, priv, elligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := tcpPair(t)
+	done := make(chan Conn, 1)
+	go func() {
+		server, err := WrapAccepted(b, priv, elligator)
+		if err != nil {
+			t.Error(err)
+			b.Close()
+		}
+		done <- server
+	}()
+	client, err := Client(a, &Config{ServerPublicKey: &pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-done
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+	testRoundTrip(t, client, server)
+
+	_, _, otherElligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, d := tcpPair(t)
+	defer c.Close()
+	defer d.Close()
+	if _, err = WrapAccepted(d, priv, otherElligator); !errors.Is(err, ErrInvalidRepresentative) {
+		t.Fatal(err)
+	}
+}
+
+func TestWrapWithSharedKey(t *testing.T) {
+	var shared [32]byte
+	copy(shared[:], randomBytes(t, 32))
+	a, b := tcpPair(t)
+	recorded := &recordingConn{Conn: a}
+	client, err := WrapWithSharedKey(recorded, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := WrapServerWithSharedKey(b, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if len(recorded.bytes()) != 0 {
+		t.Fatal("handshake sent")
+	}
+	if *client.GetPublicKey() != [32]byte{} || *server.GetServerPublicKey() != [32]byte{} {
+		t.Fatal("public keys set")
+	}
+	testRoundTrip(t, client, server)
+
+	other := shared
+	other[0] ^= 1
+	c, d := tcpPair(t)
+	defer c.Close()
+	defer d.Close()
+	client, _ = WrapWithSharedKey(c, shared)
+	server, _ = WrapServerWithSharedKey(d, other)
+	go client.WriteMessage([]byte("mismatched"))
+	if _, err = server.ReadMessage(); !errors.As(err, new(*AuthError)) {
+		t.Fatal(err)
+	}
+}
+
+// Both ends read a line through their bufio.Reader before the handshake, which
+// may have buffered the start of it
+func TestWithReader(t *testing.T) {
+	a, b := tcpPair(t)
+	preamble := func(c net.Conn, line string) (r *bufio.Reader, err error) {
+		if err = writeFull(c, []byte(line+"\n")); err != nil {
+			return
+		}
+		r = bufio.NewReader(c)
+		_, err = r.ReadString('\n')
+		return
+	}
+	done := make(chan Conn, 1)
+	go func() {
+		r, err := preamble(b, "server")
+		var server Conn
+		if err == nil {
+			server, err = ServerWithReader(b, r, nil)
+		}
+		if err != nil {
+			t.Error(err)
+			b.Close()
+		}
+		done <- server
+	}()
+	r, err := preamble(a, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ClientWithReader(a, r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-done
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+	testRoundTrip(t, client, server)
+}
+
+// ReadString returns messages as they were written, newlines are not delimiters.
+// Read as a stream, a line goes on across frames until its delimiter
+func TestReadString(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	messages := []string{"line one\nline", " two\n", "grüße\n"}
+	go func() {
+		for _, s := range messages {
+			client.WriteString(s)
+		}
+	}()
+	for _, want := range messages {
+		if s, err := server.ReadString(); err != nil || s != want {
+			t.Fatalf("%q %v", s, err)
+		}
+	}
+
+	go func() {
+		for _, s := range messages {
+			client.WriteString(s)
+		}
+	}()
+	lines := bufio.NewReader(server)
+	for _, want := range []string{"line one\n", "line two\n", "grüße\n"} {
+		if s, err := lines.ReadString('\n'); err != nil || s != want {
+			t.Fatalf("%q %v", s, err)
+		}
+	}
+
+	// What a partial Read left of a message is the rest of it
+	go client.WriteString("partial read")
+	if _, err := io.ReadFull(server, make([]byte, len("partial"))); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := server.ReadString(); err != nil || s != " read" {
+		t.Fatalf("%q %v", s, err)
+	}
+}
@@ -0,0 +1,204 @@
+package securenet
+
+import (
+	"context"
+	"time"
+)
+
+// A deadline in the past, so pending I/O on the underlying connection fails at once
+var expired = time.Unix(1, 0)
+
+func (c *conn) SetDeadline(t time.Time) (err error) {
+	err = c.SetReadDeadline(t)
+	if err != nil {
+		return
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Deadlines are remembered, so the per-call context of ReadMessageContext can restore them
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Every frame read gets d from when reading it starts, so a connection that stays
+// idle for d fails with a net.Error whose Timeout() is true. The read deadline
+// still applies when it is earlier, zero turns the timeout off
+func (c *conn) SetReadTimeout(d time.Duration) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readTimeout = d
+	if d == 0 && !c.readExpired {
+		c.Conn.SetReadDeadline(c.readDeadline)
+	}
+}
+
+// Every frame written gets d, like SetReadTimeout for reads
+func (c *conn) SetWriteTimeout(d time.Duration) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.writeTimeout = d
+	if d == 0 && !c.writeExpired {
+		c.Conn.SetWriteDeadline(c.writeDeadline)
+	}
+}
+
+// Called before each frame is read or written
+func (c *conn) refreshDeadline(read bool) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	timeout, deadline, expired := c.writeTimeout, c.writeDeadline, c.writeExpired
+	if read {
+		timeout, deadline, expired = c.readTimeout, c.readDeadline, c.readExpired
+	}
+	if timeout == 0 || expired {
+		return
+	}
+	if t := time.Now().Add(timeout); deadline.IsZero() || t.Before(deadline) {
+		deadline = t
+	}
+	if read {
+		c.Conn.SetReadDeadline(deadline)
+	} else {
+		c.Conn.SetWriteDeadline(deadline)
+	}
+}
+
+// Once ctx is done the read fails with ctx.Err(), a frame cut short is resumed by the next read
+func (c *conn) ReadMessageContext(ctx context.Context) (b []byte, err error) {
+	err = c.handshakeFirst(ctx)
+	if err != nil {
+		return
+	}
+	err = c.withContext(ctx, true, func() (err error) {
+		b, err = c.ReadMessage()
+		return
+	})
+	return
+}
+
+// Once ctx is done the write fails with ctx.Err(). Part of the frame may have been
+// sent then, and the connection should be closed as the peer can not read past it
+func (c *conn) WriteMessageContext(ctx context.Context, b []byte) error {
+	err := c.handshakeFirst(ctx)
+	if err != nil {
+		return err
+	}
+	return c.withContext(ctx, false, func() error {
+		return c.WriteMessage(b)
+	})
+}
+
+// The underlying deadline is only touched once ctx is done, and restored afterwards
+func (c *conn) withContext(ctx context.Context, read bool, op func() error) (err error) {
+	if ctx.Done() == nil {
+		return op()
+	}
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+	// With expire unset, this restores the deadline last set on the Conn
+	setDeadline := func(expire bool) {
+		c.deadlineLock.Lock()
+		defer c.deadlineLock.Unlock()
+		if read {
+			t := c.readDeadline
+			if expire {
+				t = expired
+			}
+			c.readExpired = expire
+			c.Conn.SetReadDeadline(t)
+		} else {
+			t := c.writeDeadline
+			if expire {
+				t = expired
+			}
+			c.writeExpired = expire
+			c.Conn.SetWriteDeadline(t)
+		}
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(true)
+		case <-stop:
+		}
+	}()
+	err = op()
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		setDeadline(false)
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	return
+}
+
+// Until the returned func is called, ctx being done fails pending handshake I/O
+// at once rather than at the deadline. The deadlines last set on the Conn are
+// restored then
+func (c *conn) watchHandshake(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.Conn.SetDeadline(expired)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if ctx.Err() == nil {
+			return
+		}
+		c.restoreDeadlines()
+	}
+}
+
+// Deadlines set with SetReadDeadline or SetWriteDeadline that are earlier than
+// the handshake's still apply
+func (c *conn) setHandshakeDeadline(t time.Time) (err error) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	read, write := t, t
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(t) {
+		read = c.readDeadline
+	}
+	if !c.writeDeadline.IsZero() && c.writeDeadline.Before(t) {
+		write = c.writeDeadline
+	}
+	err = c.Conn.SetReadDeadline(read)
+	if err != nil {
+		return
+	}
+	return c.Conn.SetWriteDeadline(write)
+}
+
+// This puts back the deadlines set with SetReadDeadline and SetWriteDeadline
+func (c *conn) restoreDeadlines() {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.Conn.SetReadDeadline(c.readDeadline)
+	c.Conn.SetWriteDeadline(c.writeDeadline)
+}
@@ -0,0 +1,137 @@
+package securenet
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReadMessageContext(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := server.ReadMessageContext(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := server.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if _, err := server.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("done context", err)
+	}
+
+	// Neither left the underlying deadline in the past
+	go client.WriteMessage([]byte("after"))
+	if m, err := server.ReadMessage(); err != nil || string(m) != "after" {
+		t.Fatal(string(m), err)
+	}
+}
+
+// The deadline set on the Conn still applies once the context is gone
+func TestContextKeepsDeadline(t *testing.T) {
+	_, server := testConns(t, nil, nil)
+	server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := server.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := server.ReadMessage(); !isTimeout(err) {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatal("deadline moved, read failed after", elapsed)
+	}
+}
+
+// A frame cut short by the context is read in full by the next read
+func TestReadMessageContextResumes(t *testing.T) {
+	client, server, recorded := recordedConns(t, nil, nil)
+	frame := heldFrame(t, client, recorded, "resumed")
+	if _, err := recorded.Conn.Write(frame[:len(frame)/2]); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := server.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if _, err := recorded.Conn.Write(frame[len(frame)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := server.ReadMessage(); err != nil || string(m) != "resumed" {
+		t.Fatal(string(m), err)
+	}
+}
+
+func TestWriteMessageContext(t *testing.T) {
+	client, _ := pipeConns(t, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.WriteMessageContext(ctx, []byte("never")); err != context.Canceled {
+		t.Fatal(err)
+	}
+	// Nobody reads the pipe, so the write blocks until the context is done
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.WriteMessageContext(ctx, []byte("blocked")); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+// The timeout counts from each read, so a steady peer never trips it
+func TestReadTimeout(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	server.SetReadTimeout(100 * time.Millisecond)
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(40 * time.Millisecond)
+			client.WriteMessage([]byte("steady"))
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		if _, err := server.ReadMessage(); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if _, err := server.ReadMessage(); !isTimeout(err) {
+		t.Fatal(err)
+	}
+}
+
+// An earlier deadline wins over the timeout, and turning the timeout off
+// puts back the deadline
+func TestReadTimeoutKeepsDeadline(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	server.SetReadTimeout(time.Hour)
+	if _, err := server.ReadMessage(); !isTimeout(err) {
+		t.Fatal(err)
+	}
+
+	server.SetReadDeadline(time.Time{})
+	server.SetReadTimeout(20 * time.Millisecond)
+	if _, err := server.ReadMessage(); !isTimeout(err) {
+		t.Fatal(err)
+	}
+	server.SetReadTimeout(0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.WriteMessage([]byte("late"))
+	}()
+	if m, err := server.ReadMessage(); err != nil || string(m) != "late" {
+		t.Fatal(string(m), err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	client, _ := pipeConns(t, nil, nil)
+	client.SetWriteTimeout(50 * time.Millisecond)
+	// Nobody reads the pipe
+	if err := client.WriteMessage([]byte("blocked")); !isTimeout(err) {
+		t.Fatal(err)
+	}
+}
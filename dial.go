@@ -1,14 +1,142 @@
 package securenet
 
 import (
+	"context"
 	"net"
+	"time"
 )
 
+// The zero Dialer dials like Dial, its fields are only read by Dial and DialContext
+type Dialer struct {
+	// Bounds both the connect and the handshake when set
+	Timeout time.Duration
+	// The address to dial from, ignored when Transport is set
+	LocalAddr net.Addr
+	// When set, the connection is closed unless the server presents this key,
+	// taking precedence over Config.ServerPublicKey
+	ServerPublicKey *[32]byte
+	// A nil config uses the defaults
+	Config *Config
+	// When set, this makes the underlying connection instead of a net.Dialer
+	Transport ContextDialer
+}
+
+func (d *Dialer) Dial(network, address string) (c Conn, err error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// The context bounds both the connect and the handshake, as Timeout does
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (c Conn, err error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	transport := d.Transport
+	if transport == nil {
+		transport = &net.Dialer{LocalAddr: d.LocalAddr}
+	}
+	config := d.Config
+	if d.ServerPublicKey != nil {
+		pinned := Config{}
+		if config != nil {
+			pinned = *config
+		}
+		pinned.ServerPublicKey = d.ServerPublicKey
+		config = &pinned
+	}
+	return dialWith(ctx, transport, network, address, config)
+}
+
 func Dial(network, address string) (c Conn, err error) {
-	oC, err := net.Dial(network, address)
+	return (&Dialer{}).Dial(network, address)
+}
+
+// The context bounds both the connect and the handshake
+func DialContext(ctx context.Context, network, address string) (c Conn, err error) {
+	return (&Dialer{}).DialContext(ctx, network, address)
+}
+
+// The timeout bounds both the connect and the handshake, running out of time
+// returns a net.Error with Timeout() == true
+func DialTimeout(network, address string, timeout time.Duration) (c Conn, err error) {
+	return (&Dialer{Timeout: timeout}).Dial(network, address)
+}
+
+// The connection is closed unless the server presents the expected public key
+func DialWithServerKey(network, address string, expected [32]byte) (c Conn, err error) {
+	return (&Dialer{ServerPublicKey: &expected}).Dial(network, address)
+}
+
+// The handshake completes before verify sees the server's public key, and the
+// connection is closed with verify's error unless it returns nil. Nothing is
+// written to or read from the connection in between
+func DialAndVerify(network, address string, verify func(serverKey *[32]byte) error) (c Conn, err error) {
+	c, err = Dial(network, address)
+	if err != nil {
+		return
+	}
+	err = verify(c.GetServerPublicKey())
+	if err != nil {
+		c.Close()
+		c = nil
+	}
+	return
+}
+
+// A path starting with @ names a socket in the abstract namespace on Linux.
+// LocalAddr and RemoteAddr are the *net.UnixAddr of the underlying connection,
+// the client's is usually unnamed, so the server tells clients apart by key
+func DialUnix(path string) (c Conn, err error) {
+	return Dial("unix", path)
+}
+
+// The connection is made from laddr, which is resolved for the network like raddr
+func DialFrom(network, laddr, raddr string) (c Conn, err error) {
+	local, err := resolveLocal(network, laddr)
+	if err != nil {
+		return
+	}
+	return (&Dialer{LocalAddr: local}).Dial(network, raddr)
+}
+
+// Anything that makes the underlying connection, like *net.Dialer or the
+// dialers of golang.org/x/net/proxy, which satisfy proxy.ContextDialer
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Lets a plain function serve as a ContextDialer
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f DialContextFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// The handshake runs over whatever connection the dialer makes, so it can go
+// through a SOCKS5 proxy or any other transport
+func DialWith(dialer ContextDialer, network, address string) (c Conn, err error) {
+	return (&Dialer{Transport: dialer}).Dial(network, address)
+}
+
+func resolveLocal(network, laddr string) (addr net.Addr, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return net.ResolveTCPAddr(network, laddr)
+	case "unix", "unixpacket":
+		return net.ResolveUnixAddr(network, laddr)
+	}
+	return nil, net.UnknownNetworkError(network)
+}
+
+func dialWith(ctx context.Context, d ContextDialer, network, address string, config *Config) (c Conn, err error) {
+	oC, err := d.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
-	c, err = Wrap(oC)
+	c, err = wrapConfig(ctx, oC, false, config)
+	if err != nil {
+		oC.Close()
+	}
 	return
 }
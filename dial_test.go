@@ -0,0 +1,304 @@
+package securenet
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUnixSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "securenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := []string{filepath.Join(dir, "socket")}
+	if runtime.GOOS == "linux" {
+		paths = append(paths, "@securenet-test-"+strconv.Itoa(os.Getpid()))
+	}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			l, err := Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			accepted := make(chan Conn, 1)
+			received := make(chan string, 1)
+			go func() {
+				s, err := l.AcceptConn()
+				accepted <- s
+				if err == nil {
+					m, _ := s.ReadMessage()
+					received <- string(m)
+				}
+			}()
+			c, err := DialUnix(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			s := <-accepted
+			if s == nil {
+				t.Fatal("accept failed")
+			}
+			defer s.Close()
+
+			if err = c.WriteMessage([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if m := <-received; m != "hello" {
+				t.Fatal(m)
+			}
+			if *c.GetServerPublicKey() != *l.GetPublicKey() {
+				t.Fatal("client did not see the listener key")
+			}
+
+			for _, addr := range []net.Addr{c.LocalAddr(), c.RemoteAddr(), s.LocalAddr(), s.RemoteAddr()} {
+				if _, ok := addr.(*net.UnixAddr); !ok || addr.Network() != "unix" {
+					t.Fatalf("%T %v", addr, addr)
+				}
+			}
+			if c.RemoteAddr().String() != path || s.LocalAddr().String() != path {
+				t.Fatal(c.RemoteAddr(), s.LocalAddr())
+			}
+		})
+	}
+}
+
+func TestUnixDatagramRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "securenet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socket")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+	raw, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err = Client(raw, nil); !errors.Is(err, ErrUnsupportedTransport) {
+		t.Fatal(err)
+	}
+}
+
+// Accepts connections and never answers them
+func silentListener(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	return l
+}
+
+// A listener reading one message from every client
+func readingListener(t *testing.T) (l Listener, received <-chan string) {
+	t.Helper()
+	l = testListener(t, nil)
+	messages := make(chan string, 16)
+	go func() {
+		for {
+			c, err := l.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if m, err := c.ReadMessage(); err == nil {
+					messages <- string(m)
+				}
+			}()
+		}
+	}()
+	return l, messages
+}
+
+func testDialed(t *testing.T, c Conn, err error, l Listener, received <-chan string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if *c.GetServerPublicKey() != *l.GetPublicKey() {
+		t.Fatal("dialed another server")
+	}
+	if err = c.WriteMessage([]byte("dialed")); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-received; m != "dialed" {
+		t.Fatal(m)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	l, received := readingListener(t)
+	c, err := DialContext(context.Background(), "tcp", l.Addr().String())
+	testDialed(t, c, err, l, received)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = DialContext(ctx, "tcp", l.Addr().String()); !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = DialContext(ctx, "tcp", silentListener(t).Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	l, received := readingListener(t)
+	c, err := DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	testDialed(t, c, err, l, received)
+
+	start := time.Now()
+	if _, err = DialTimeout("tcp", silentListener(t).Addr().String(), 50*time.Millisecond); !isTimeout(err) {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("timed out after", elapsed)
+	}
+}
+
+func TestDialFrom(t *testing.T) {
+	// A free port to dial from
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := free.Addr().String()
+	free.Close()
+
+	l := testListener(t, nil)
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		c, err := l.AcceptConn()
+		if err == nil {
+			accepted <- c.RemoteAddr()
+			c.ReadMessage()
+			c.Close()
+		}
+	}()
+	c, err := DialFrom("tcp", laddr, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.LocalAddr().String() != laddr || (<-accepted).String() != laddr {
+		t.Fatal(c.LocalAddr())
+	}
+
+	var unknown net.UnknownNetworkError
+	if _, err = DialFrom("udp", "127.0.0.1:0", l.Addr().String()); !errors.As(err, &unknown) {
+		t.Fatal(err)
+	}
+	if _, err = DialFrom("tcp", "not an address", l.Addr().String()); err == nil {
+		t.Fatal("dialed from a malformed address")
+	}
+}
+
+func TestDialWith(t *testing.T) {
+	l, received := readingListener(t)
+	var dialed []string
+	transport := DialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+	c, err := DialWith(transport, "tcp", l.Addr().String())
+	testDialed(t, c, err, l, received)
+	if len(dialed) != 1 || dialed[0] != "tcp "+l.Addr().String() {
+		t.Fatal(dialed)
+	}
+
+	refused := errors.New("refused")
+	failing := DialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, refused
+	})
+	if _, err = DialWith(failing, "tcp", l.Addr().String()); err != refused {
+		t.Fatal(err)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	l, received := readingListener(t)
+	c, err := (&Dialer{}).Dial("tcp", l.Addr().String())
+	testDialed(t, c, err, l, received)
+
+	other, _, _, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testKeys(t)
+	config.ServerPublicKey = &other
+	// The Dialer's key wins over the one of its Config
+	d := &Dialer{Config: config, ServerPublicKey: l.GetPublicKey(), Timeout: 5 * time.Second}
+	c, err = d.DialContext(context.Background(), "tcp", l.Addr().String())
+	testDialed(t, c, err, l, received)
+	if config.ServerPublicKey != &other {
+		t.Fatal("Config changed")
+	}
+
+	d.ServerPublicKey = &other
+	if _, err = d.Dial("tcp", l.Addr().String()); !errors.Is(err, ErrServerKeyMismatch) {
+		t.Fatal(err)
+	}
+}
+
+func TestDialAndVerify(t *testing.T) {
+	l, received := readingListener(t)
+	var seen [32]byte
+	c, err := DialAndVerify("tcp", l.Addr().String(), func(serverKey *[32]byte) error {
+		seen = *serverKey
+		return nil
+	})
+	testDialed(t, c, err, l, received)
+	if seen != *l.GetPublicKey() {
+		t.Fatal("verified another key")
+	}
+
+	refused := errors.New("refused")
+	c, err = DialAndVerify("tcp", l.Addr().String(), func(serverKey *[32]byte) error { return refused })
+	if err != refused || c != nil {
+		t.Fatal(c, err)
+	}
+}
+
+func TestDialWithServerKey(t *testing.T) {
+	l, received := readingListener(t)
+	c, err := DialWithServerKey("tcp", l.Addr().String(), *l.GetPublicKey())
+	testDialed(t, c, err, l, received)
+
+	other, _, _, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = DialWithServerKey("tcp", l.Addr().String(), other); !errors.Is(err, ErrServerKeyMismatch) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,99 @@
+package securenet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Clients sending early data set this bit in the version byte of their hello
+const earlyFlag = 0x40
+
+// Early data is read before the client is authenticated, so it is kept small
+const maxEarlyDataSize = 16 << 10
+
+// Early data is only sent with a pinned server key in a static handshake
+func (c *Config) earlyData() []byte {
+	if c == nil || len(c.EarlyData) == 0 {
+		return nil
+	}
+	return c.EarlyData
+}
+
+func (h *handshake) checkEarlyData() (err error) {
+	data := h.config.earlyData()
+	if h.server || data == nil {
+		return
+	}
+	if h.config.ServerPublicKey == nil || h.config.Ephemeral || h.config.Noise || h.config.SessionTicket != nil {
+		return ErrEarlyData
+	}
+	if len(data) > maxEarlyDataSize {
+		return fmt.Errorf("%w: %d bytes of early data", ErrEarlyData, len(data))
+	}
+	return
+}
+
+// The static DH of both keys, bound to the client's hello
+func (h *handshake) earlyKey(peerKey *[32]byte) *[32]byte {
+	var dh [32]byte
+	box.Precompute(&dh, peerKey, h.priv)
+	defer wipe(dh[:])
+	bound := bindTranscript(&dh, h.config.psk(), h.transcript)
+	defer wipe(bound[:])
+	return mixKeys("securenet early data", bound)
+}
+
+// The client's hello is followed by the length of the early data as 4 little
+// endian bytes, a random nonce and the data sealed with secretbox under the
+// early key. All of it is part of the transcript
+func (h *handshake) writeEarlyData(data []byte) (err error) {
+	key := h.earlyKey(h.config.ServerPublicKey)
+	defer wipe(key[:])
+	msg := make([]byte, 4+24, 4+24+len(data)+secretbox.Overhead)
+	binary.LittleEndian.PutUint32(msg, uint32(len(data)))
+	_, err = io.ReadFull(h.config.rand(), msg[4:])
+	if err != nil {
+		return
+	}
+	var nonce [24]byte
+	copy(nonce[:], msg[4:])
+	msg = secretbox.Seal(msg, data, &nonce, key)
+	h.transcript = append(h.transcript, msg...)
+	return writeFull(h.oc, msg)
+}
+
+// Servers without Config.AcceptEarlyData fail the handshake instead
+func (h *handshake) readEarlyData(peerKey *[32]byte) (err error) {
+	if h.config == nil || !h.config.AcceptEarlyData {
+		return fmt.Errorf("%w: unexpected early data", ErrHandshake)
+	}
+	var length [4]byte
+	_, err = io.ReadFull(h.bRead, length[:])
+	if err != nil {
+		return
+	}
+	size := binary.LittleEndian.Uint32(length[:])
+	if size > maxEarlyDataSize {
+		return fmt.Errorf("%w: %d bytes of early data", ErrHandshake, size)
+	}
+	sealed := make([]byte, 24+int(size)+secretbox.Overhead)
+	_, err = io.ReadFull(h.bRead, sealed)
+	if err != nil {
+		return
+	}
+	key := h.earlyKey(peerKey)
+	defer wipe(key[:])
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	data, ok := secretbox.Open(nil, sealed[24:], &nonce, key)
+	if !ok {
+		return fmt.Errorf("%w: early data does not open", ErrHandshake)
+	}
+	h.earlyData = data
+	h.transcript = append(append(h.transcript, length[:]...), sealed...)
+	return
+}
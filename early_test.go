@@ -0,0 +1,84 @@
+package securenet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// A client config pinning the key of the returned server config
+func pinnedConfigs(t *testing.T) (clientConfig, serverConfig *Config) {
+	t.Helper()
+	pub, priv, elligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig = testKeys(t)
+	clientConfig.ServerPublicKey = &pub
+	return clientConfig, &Config{PrivateKey: &priv, Representative: &elligator}
+}
+
+func TestEarlyData(t *testing.T) {
+	clientConfig, serverConfig := pinnedConfigs(t)
+	clientConfig.EarlyData = []byte("early")
+	serverConfig.AcceptEarlyData = true
+	client, server := testConns(t, clientConfig, serverConfig)
+	if !client.ConnectionState().EarlyData || !server.ConnectionState().EarlyData {
+		t.Fatal("early data not reported")
+	}
+	go client.WriteMessage([]byte("late"))
+	for _, want := range []string{"early", "late"} {
+		if m, err := server.ReadMessage(); err != nil || string(m) != want {
+			t.Fatal(string(m), err)
+		}
+	}
+}
+
+func TestEarlyDataNotAccepted(t *testing.T) {
+	clientConfig, serverConfig := pinnedConfigs(t)
+	clientConfig.EarlyData = []byte("early")
+	a, b := tcpPair(t)
+	defer a.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Client(a, clientConfig)
+		done <- err
+	}()
+	if _, err := Server(b, serverConfig); !errors.Is(err, ErrHandshake) {
+		t.Fatal(err)
+	}
+	b.Close()
+	if err := <-done; err == nil {
+		t.Fatal("client handshake succeeded")
+	}
+}
+
+// The client refuses before writing anything
+func TestEarlyDataConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		apply func(c *Config)
+	}{
+		{"Ephemeral", func(c *Config) { c.Ephemeral = true }},
+		{"Noise", func(c *Config) { c.Noise = true }},
+		{"SessionTicket", func(c *Config) { c.SessionTicket = &SessionTicket{} }},
+		{"NoServerPublicKey", func(c *Config) { c.ServerPublicKey = nil }},
+		{"TooLarge", func(c *Config) { c.EarlyData = bytes.Repeat([]byte{1}, maxEarlyDataSize+1) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig, _ := pinnedConfigs(t)
+			clientConfig.EarlyData = []byte("early")
+			tc.apply(clientConfig)
+			a, b := tcpPair(t)
+			defer a.Close()
+			defer b.Close()
+			recorded := &recordingConn{Conn: a}
+			if _, err := Client(recorded, clientConfig); !errors.Is(err, ErrEarlyData) {
+				t.Fatal(err)
+			}
+			if n := len(recorded.bytes()); n != 0 {
+				t.Fatal(n, "bytes written")
+			}
+		})
+	}
+}
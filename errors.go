@@ -0,0 +1,82 @@
+package securenet
+
+import (
+	"errors"
+	"net"
+)
+
+// Use errors.Is to match these, decryption failures indicate tampering or corruption
+var (
+	ErrHeaderDecrypt         = errors.New("OpenAfterPrecomputation failed on header")
+	ErrBodyDecrypt           = errors.New("OpenAfterPrecomputation failed on data")
+	ErrFrameTooLarge         = errors.New("frame exceeds maximum frame size")
+	ErrServerKeyMismatch     = errors.New("server public key does not match the expected key")
+	ErrClientNotAuthorized   = errors.New("client public key is not authorized")
+	ErrWriteClosed           = errors.New("write side of connection is closed")
+	ErrSequenceMismatch      = errors.New("frame arrived out of sequence")
+	ErrMalformedFrame        = errors.New("malformed frame")
+	ErrHandshake             = errors.New("handshake failed")
+	ErrInvalidKey            = errors.New("invalid key encoding")
+	ErrInvalidPeerKey        = errors.New("peer public key has low order")
+	ErrNotHandshaked         = errors.New("handshake has not completed")
+	ErrNoRepresentative      = errors.New("private key has no elligator representative")
+	ErrUnsupportedVersion    = errors.New("no protocol version supported by both sides")
+	ErrNonceReuse            = errors.New("refusing to reuse a nonce")
+	ErrClosed                = errors.New("connection is closed")
+	ErrUnknownPeer           = errors.New("address is not the peer of this session")
+	ErrExportLength          = errors.New("keying material length out of range")
+	ErrInvalidRepresentative = errors.New("invalid elligator representative")
+	ErrInvalidParams         = errors.New("invalid key derivation parameters")
+	ErrInvalidUnreadByte     = errors.New("UnreadByte must directly follow ReadByte")
+	ErrReflectedKey          = errors.New("peer presented our own public key")
+	ErrUnsupportedAEAD       = errors.New("unsupported AEAD")
+	ErrUnsupported           = errors.New("not supported by the underlying connection")
+	ErrUnsupportedTransport  = errors.New("underlying connection is not a reliable stream")
+	ErrEarlyData             = errors.New("early data needs a pinned server key and a static handshake")
+	ErrKeygenExhausted       = errors.New("no private key with a representative found, the random source may be broken")
+	ErrEmptyMessage          = errors.New("empty messages can not be sent")
+	ErrNoiseTransport        = errors.New("only data is sent over the Noise transport")
+)
+
+// A frame that fails to open was tampered with or corrupted, unlike the errors
+// of the underlying connection this is not worth retrying. The connection is
+// closed by the read that returns it, later reads and writes return ErrClosed.
+// errors.Is matches it against ErrHeaderDecrypt or ErrBodyDecrypt. When the
+// header of the very first frame fails, both ends came out of the handshake with
+// different keys, or the peer sent more than its handshake messages, so it
+// matches ErrHandshake too
+type AuthError struct {
+	// Whether the header or the body of the frame failed to open
+	Header bool
+	// The sequence number the frame was expected to have
+	Sequence uint64
+}
+
+func (e *AuthError) Error() string {
+	return e.sentinel().Error()
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == e.sentinel() || (target == ErrHandshake && e.Header && e.Sequence == 0)
+}
+
+func (e *AuthError) sentinel() error {
+	if e.Header {
+		return ErrHeaderDecrypt
+	}
+	return ErrBodyDecrypt
+}
+
+// Implements net.Error with Timeout() == true
+var ErrHandshakeTimeout net.Error = &timeoutError{"handshake timed out"}
+
+// Implements net.Error with Timeout() == true
+var ErrKeepAliveTimeout net.Error = &timeoutError{"peer sent nothing within the keepalive timeout"}
+
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,46 @@
+package securenet
+
+type EventType int
+
+const (
+	EventHandshakeStart EventType = iota
+	EventHandshakeComplete
+	EventHandshakeFailed
+	EventFrameSent
+	EventFrameReceived
+	EventDecryptFailure
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventHandshakeStart:
+		return "handshake start"
+	case EventHandshakeComplete:
+		return "handshake complete"
+	case EventHandshakeFailed:
+		return "handshake failed"
+	case EventFrameSent:
+		return "frame sent"
+	case EventFrameReceived:
+		return "frame received"
+	case EventDecryptFailure:
+		return "decrypt failure"
+	}
+	return "unknown event"
+}
+
+// Events never carry key material or plaintext
+type Event struct {
+	Type EventType
+	// Bytes on the wire for frame events
+	Size int
+	// Set for failures
+	Err error
+}
+
+// Events are delivered synchronously, a slow callback slows down the connection
+func (c *conn) event(e Event) {
+	if c.config != nil && c.config.OnEvent != nil {
+		c.config.OnEvent(e)
+	}
+}
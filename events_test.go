@@ -0,0 +1,63 @@
+package securenet
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The callback runs without stateLock held, so it may look at the connection
+func TestOnEventConnectionState(t *testing.T) {
+	pub, priv, elligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		lock   sync.Mutex
+		events []EventType
+		client Conn
+		state  ConnectionState
+	)
+	config := &Config{OnEvent: func(e Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, e.Type)
+		if e.Type == EventHandshakeComplete {
+			state = client.ConnectionState()
+		}
+	}}
+	a, b := tcpPair(t)
+	client = NewClientConn(a, pub, priv, elligator, config)
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		server, err := Server(b, nil)
+		if err == nil {
+			server.ReadMessage()
+			server.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = client.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.WriteMessage([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !state.HandshakeComplete || state.LocalPublicKey != pub {
+		t.Fatal(state)
+	}
+	want := []EventType{EventHandshakeStart, EventHandshakeComplete, EventFrameSent}
+	if len(events) < len(want) {
+		t.Fatal(events)
+	}
+	for i, e := range want {
+		if events[i] != e {
+			t.Fatal(events)
+		}
+	}
+}
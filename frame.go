@@ -0,0 +1,518 @@
+package securenet
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	frameData byte = iota
+	frameRekey
+	frameKeepAlive
+	frameKeepAliveAck
+	framePing
+	framePong
+	frameCompression
+	frameCompressed
+	frameRehandshakeRequest
+	frameRehandshakeResponse
+	frameRehandshakeConfirm
+	frameTicket
+	frameClose
+)
+
+// Set in the type of padded frames, whose plaintext starts with the length of
+// the payload as 4 little endian bytes and ends in zeros
+const paddedFlag byte = 0x80
+
+const headerSize = 8 + 4 + 1 // sequence number, body length, frame type
+
+// The plaintext a single unpadded frame of frameSize bytes on the wire can carry, or zero if none.
+// This counts the nonce only version 1 sends, so the result fits every version
+func MaxPayloadForFrame(frameSize int) int {
+	if frameSize < frameOverhead {
+		return 0
+	}
+	return frameSize - frameOverhead
+}
+
+// The same for frames padded to a multiple of padding as Config.Padding does,
+// whose plaintext also holds the payload length and the padding
+func MaxPaddedPayloadForFrame(frameSize int, padding uint32) int {
+	if padding == 0 {
+		return MaxPayloadForFrame(frameSize)
+	}
+	plaintext := uint64(MaxPayloadForFrame(frameSize))
+	plaintext -= plaintext % uint64(padding)
+	if plaintext < 4 {
+		return 0
+	}
+	return int(plaintext - 4)
+}
+
+// An empty data frame or a close frame marks the end of the peer's writes,
+// control frames are handled here and never returned. From version 5 on, the
+// connection ending without either is read as io.ErrUnexpectedEOF. A frame that
+// fails to open, arrives out of sequence, is too large or malformed leaves the
+// stream out of step, so the connection fails with that error and every later
+// read or write returns ErrClosed.
+// The plaintext is only valid until the next frame is read
+func (c *conn) readFrame() (decrypted []byte, err error) {
+	if !c.handshakeComplete {
+		err = ErrNotHandshaked
+		return
+	}
+	if c.isClosed() {
+		err = ErrClosed
+		return
+	}
+	for {
+		if c.readClosed {
+			err = io.EOF
+			return
+		}
+		var frameType byte
+		c.refreshDeadline(true)
+		frameType, decrypted, err = c.readRawFrame()
+		if err != nil {
+			if outOfStep(err) {
+				c.fail()
+			} else if atomic.LoadInt32(&c.peerTimedOut) == 1 {
+				err = ErrKeepAliveTimeout
+			} else if err == io.EOF && c.version >= Version5 {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		switch frameType {
+		case frameData:
+			if len(decrypted) == 0 {
+				c.readClosed = true
+				err = io.EOF
+			} else {
+				atomic.AddUint64(&c.stats.DataFramesReceived, 1)
+			}
+			atomic.AddUint64(&c.stats.BytesReceived, uint64(len(decrypted)))
+			return
+		case frameRekey:
+			if len(decrypted) != 32 {
+				err = fmt.Errorf("%w: rekey frame of %d bytes", ErrMalformedFrame, len(decrypted))
+				return
+			}
+			next := deriveRekey(c.recvKey, decrypted)
+			wipe(c.recvKey[:])
+			c.recvKey = next
+			atomic.AddUint64(&c.stats.Rekeys, 1)
+		case frameKeepAlive:
+			c.queueReply(frameKeepAliveAck, nil)
+		case frameKeepAliveAck:
+		case framePing:
+			c.queueReply(framePong, append([]byte{}, decrypted...))
+		case framePong:
+			err = c.handlePong(decrypted)
+			if err != nil {
+				return
+			}
+		case frameCompression:
+			err = c.handleCompression(decrypted)
+			if err != nil {
+				return
+			}
+		case frameRehandshakeRequest:
+			err = c.handleRehandshakeRequest(decrypted)
+		case frameRehandshakeResponse:
+			err = c.handleRehandshakeResponse(decrypted)
+		case frameRehandshakeConfirm:
+			err = c.handleRehandshakeConfirm()
+		case frameTicket:
+			err = c.handleTicket(decrypted)
+		case frameClose:
+			c.readClosed = true
+			err = io.EOF
+			return
+		case frameCompressed:
+			decrypted, err = c.decompress(decrypted)
+			if err != nil {
+				return
+			}
+			atomic.AddUint64(&c.stats.DataFramesReceived, 1)
+			atomic.AddUint64(&c.stats.BytesReceived, uint64(len(decrypted)))
+			return
+		default:
+			err = fmt.Errorf("%w: unknown frame type %d", ErrMalformedFrame, frameType)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func outOfStep(err error) bool {
+	if _, ok := err.(*AuthError); ok {
+		return true
+	}
+	return err == ErrSequenceMismatch || errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrMalformedFrame)
+}
+
+// A frame is a nonce, the sealed header and the sealed body, which is opened into the reusable plaintext buffer.
+// The stream may only end on a frame boundary, a truncated frame is io.ErrUnexpectedEOF.
+// The header is sealed with the low bit of the nonce cleared and the body with
+// it set, so a body only opens together with the header it was sent with.
+// Bytes of a frame are kept across failed reads, so a read that timed out
+// partway through a frame resumes where it stopped
+func (c *conn) readRawFrame() (frameType byte, decrypted []byte, err error) {
+	if c.noise {
+		return c.readNoiseFrame()
+	}
+	nonceSize := 0
+	if c.version < Version2 {
+		nonceSize = 24
+	}
+	prefix := nonceSize + box.Overhead + headerSize
+	err = c.fill(prefix)
+	if err != nil {
+		if len(c.partial) > 0 {
+			err = midFrame(err)
+		}
+		return
+	}
+
+	var nonce [24]byte
+	if nonceSize == 0 {
+		nonce = counterNonce(&c.recvNonceBase, c.readSequence)
+	} else {
+		copy(nonce[:], c.partial)
+	}
+	headerNonce, bodyNonce := frameNonces(&nonce)
+
+	opener, err := c.opener.get(c.aead, c.recvKey)
+	if err != nil {
+		return
+	}
+	var headerPlain [headerSize]byte
+	lengthCode, openErr := opener.Open(headerPlain[:0], headerNonce[:opener.NonceSize()], c.partial[nonceSize:prefix], nil)
+	if openErr != nil {
+		err = &AuthError{Header: true, Sequence: c.readSequence}
+		atomic.AddUint64(&c.stats.DecryptFailures, 1)
+		c.event(Event{Type: EventDecryptFailure, Err: err})
+		return
+	}
+	if binary.LittleEndian.Uint64(lengthCode) != c.readSequence {
+		err = ErrSequenceMismatch
+		return
+	}
+	length := binary.LittleEndian.Uint32(lengthCode[8:])
+	if uint64(length) > uint64(c.maxFrameSize)+box.Overhead {
+		err = fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+		return
+	}
+	frameType = lengthCode[12]
+
+	size := prefix + int(length)
+	err = c.fill(size)
+	if err != nil {
+		err = midFrame(err)
+		return
+	}
+
+	dst, into := c.openBuffer(int(length) - box.Overhead)
+	decrypted, openErr = opener.Open(dst, bodyNonce[:opener.NonceSize()], c.partial[prefix:size], nil)
+	if openErr != nil {
+		err = &AuthError{Sequence: c.readSequence}
+		atomic.AddUint64(&c.stats.DecryptFailures, 1)
+		c.event(Event{Type: EventDecryptFailure, Err: err})
+		return
+	}
+	if !into {
+		c.plaintext = decrypted
+	}
+	c.partial = c.partial[:0]
+	c.readSequence++
+	atomic.AddUint64(&c.stats.FramesReceived, 1)
+	c.event(Event{Type: EventFrameReceived, Size: size})
+	if frameType&paddedFlag != 0 {
+		frameType &^= paddedFlag
+		decrypted, err = unpad(decrypted)
+	}
+	return
+}
+
+// Frames are opened into the buffer ReadMessageInto passed when they fit,
+// and into the reusable plaintext buffer otherwise
+func (c *conn) openBuffer(size int) (dst []byte, into bool) {
+	if size >= 0 && len(c.openInto) >= size {
+		return c.openInto[:0], true
+	}
+	return c.plaintext[:0], false
+}
+
+// Padding the payload to the next multiple of Config.Padding is capped at
+// maxFrameSize, and returns nil when padding is off or the payload doesn't fit
+func (c *conn) pad(b []byte) (padded []byte) {
+	if c.padding == 0 || c.version < Version7 || uint64(len(b))+4 > uint64(c.maxFrameSize) {
+		return
+	}
+	size := uint64(len(b)) + 4
+	if rest := size % uint64(c.padding); rest != 0 {
+		size += uint64(c.padding) - rest
+	}
+	if size > uint64(c.maxFrameSize) {
+		size = uint64(c.maxFrameSize)
+	}
+	padded = make([]byte, size)
+	binary.LittleEndian.PutUint32(padded, uint32(len(b)))
+	copy(padded[4:], b)
+	return
+}
+
+func unpad(padded []byte) (b []byte, err error) {
+	if len(padded) < 4 || uint64(binary.LittleEndian.Uint32(padded)) > uint64(len(padded)-4) {
+		return nil, fmt.Errorf("%w: padded frame of %d bytes", ErrMalformedFrame, len(padded))
+	}
+	return padded[4 : 4+binary.LittleEndian.Uint32(padded)], nil
+}
+
+// This reads until the partial frame holds at least n bytes. The first error is
+// returned as is, and whatever was read before it is kept for the next call.
+// The keepalive timeout runs from when this started or last received bytes,
+// and only while it waits
+func (c *conn) fill(n int) (err error) {
+	if cap(c.partial) < n {
+		grown := make([]byte, len(c.partial), n)
+		copy(grown, c.partial)
+		c.partial = grown
+	}
+	if len(c.partial) >= n {
+		return
+	}
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+	atomic.StoreInt32(&c.reading, 1)
+	defer atomic.StoreInt32(&c.reading, 0)
+	for len(c.partial) < n {
+		var read int
+		read, err = c.bufferedRead.Read(c.partial[len(c.partial):n])
+		c.partial = c.partial[:len(c.partial)+read]
+		if read > 0 {
+			atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Once part of a frame was read, running out of data is never a clean EOF
+func midFrame(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// The send key is rotated once either rekey threshold is crossed
+func (c *conn) writeFrame(b []byte) (err error) {
+	err = c.announceCompression()
+	if err != nil {
+		return
+	}
+	return c.writeFrameType(frameData, b, len(b))
+}
+
+// The rekey threshold counts plaintext bytes before compression
+func (c *conn) writeFrameType(frameType byte, b []byte, plainLen int) (err error) {
+	err = c.writeRawFrame(frameType, b)
+	if err != nil {
+		return
+	}
+	atomic.AddUint64(&c.stats.BytesSent, uint64(plainLen))
+	c.sentSinceRekey += uint64(plainLen)
+	c.framesSinceRekey++
+	if c.noise {
+		return
+	}
+	if c.sentSinceRekey >= c.rekeyAfterBytes || c.framesSinceRekey >= c.rekeyAfterFrames {
+		err = c.rekey()
+	}
+	return
+}
+
+func (c *conn) writeRawFrame(frameType byte, b []byte) (err error) {
+	if !c.handshakeComplete {
+		return ErrNotHandshaked
+	}
+	if c.writeClosed {
+		return ErrWriteClosed
+	}
+	if c.isClosed() {
+		return ErrClosed
+	}
+	// The peer refuses anything larger, and the length field must not wrap
+	if uint64(len(b)) > uint64(c.maxFrameSize) {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(b))
+	}
+	if c.noise {
+		return c.writeNoiseFrame(frameType, b)
+	}
+	sealer, err := c.sealer.get(c.aead, c.sendKey)
+	if err != nil {
+		return
+	}
+	if padded := c.pad(b); padded != nil {
+		defer wipe(padded)
+		frameType |= paddedFlag
+		b = padded
+	}
+	pooled := getBuffer(frameOverhead + len(b))
+	defer putBuffer(pooled)
+	writebuf := (*pooled)[:0]
+	outLen := len(b) + box.Overhead
+	var nonce [24]byte
+	if c.version >= Version2 {
+		nonce = counterNonce(&c.sendNonceBase, c.writeSequence)
+	} else {
+		_, err = io.ReadFull(c.rand, nonce[:])
+		if err != nil {
+			return
+		}
+	}
+	headerNonce, bodyNonce := frameNonces(&nonce)
+	if c.sentNonces != nil {
+		err = c.sentNonces.add(headerNonce)
+		if err != nil {
+			return
+		}
+	}
+	if c.version < Version2 {
+		writebuf = append(writebuf, headerNonce[:]...)
+	}
+
+	var length [headerSize]byte
+	lengthIn := uint32(outLen)
+	binary.LittleEndian.PutUint64(length[:], c.writeSequence)
+	binary.LittleEndian.PutUint32(length[8:], lengthIn)
+	length[12] = frameType
+	writebuf = sealer.Seal(writebuf, headerNonce[:sealer.NonceSize()], length[:], nil)
+	c.writeSequence++
+
+	writebuf = sealer.Seal(writebuf, bodyNonce[:sealer.NonceSize()], b, nil)
+	atomic.StoreInt64(&c.lastSent, time.Now().UnixNano())
+	c.refreshDeadline(false)
+	err = writeFull(c.Conn, writebuf)
+	if err != nil {
+		return
+	}
+	atomic.AddUint64(&c.stats.FramesSent, 1)
+	c.event(Event{Type: EventFrameSent, Size: len(writebuf)})
+	return
+}
+
+// The salt is sent under the old key, every later frame uses the derived key
+func (c *conn) rekey() (err error) {
+	salt := make([]byte, 32)
+	_, err = io.ReadFull(c.rand, salt)
+	if err != nil {
+		return
+	}
+	err = c.writeRawFrame(frameRekey, salt)
+	if err != nil {
+		return
+	}
+	next := deriveRekey(c.sendKey, salt)
+	wipe(c.sendKey[:])
+	c.sendKey = next
+	atomic.AddUint64(&c.stats.Rekeys, 1)
+	if c.sentNonces != nil {
+		c.sentNonces = newNonceHistory()
+	}
+	c.sentSinceRekey = 0
+	c.framesSinceRekey = 0
+	return
+}
+
+func deriveRekey(key *[32]byte, salt []byte) *[32]byte {
+	next := new([32]byte)
+	io.ReadFull(hkdf.New(sha256.New, key[:], salt, []byte("securenet rekey")), next[:])
+	return next
+}
+
+// Twice the sequence number is added to the low 64 bits of the base, which keeps
+// the low bit free for frameNonces, so no two frames in one direction share a nonce
+func counterNonce(base *[24]byte, sequence uint64) (nonce [24]byte) {
+	nonce = *base
+	binary.LittleEndian.PutUint64(nonce[:], binary.LittleEndian.Uint64(base[:])+sequence<<1)
+	return
+}
+
+// Both directions derive their nonce base from the session key under distinct
+// labels, followed by the client's and the server's random values from version 8 on
+func nonceBase(shared *[32]byte, label string, randoms []byte) (base [24]byte) {
+	info := append([]byte(label), randoms...)
+	io.ReadFull(hkdf.New(sha256.New, shared[:], nil, info), base[:])
+	base[0] &^= 1
+	return
+}
+
+func frameNonces(nonce *[24]byte) (header, body *[24]byte) {
+	header, body = new([24]byte), new([24]byte)
+	*header, *body = *nonce, *nonce
+	header[0] &^= 1
+	body[0] |= 1
+	return
+}
+
+const nonceHistorySize = 1 << 16
+
+// This remembers the most recent nonces sent under the current send key
+type nonceHistory struct {
+	seen  map[[24]byte]struct{}
+	order [][24]byte
+	next  int
+}
+
+func newNonceHistory() *nonceHistory {
+	return &nonceHistory{
+		seen:  make(map[[24]byte]struct{}, nonceHistorySize),
+		order: make([][24]byte, 0, nonceHistorySize),
+	}
+}
+
+func (h *nonceHistory) add(nonce *[24]byte) error {
+	if _, ok := h.seen[*nonce]; ok {
+		return ErrNonceReuse
+	}
+	if len(h.order) < nonceHistorySize {
+		h.order = append(h.order, *nonce)
+	} else {
+		delete(h.seen, h.order[h.next])
+		h.order[h.next] = *nonce
+		h.next = (h.next + 1) % nonceHistorySize
+	}
+	h.seen[*nonce] = struct{}{}
+	return nil
+}
+
+// A partially written frame corrupts the stream, so keep writing until it is flushed
+func writeFull(w io.Writer, b []byte) (err error) {
+	for len(b) > 0 {
+		var n int
+		n, err = w.Write(b)
+		b = b[n:]
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return
+}
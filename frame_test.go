@@ -0,0 +1,339 @@
+package securenet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestNonceBasesAreFresh(t *testing.T) {
+	clientConfig, serverConfig := testKeys(t), testKeys(t)
+	var bases [][24]byte
+	for i := 0; i < 2; i++ {
+		client, server := testConns(t, clientConfig, serverConfig)
+		c, s := client.(*conn), server.(*conn)
+		if c.sendNonceBase != s.recvNonceBase || c.recvNonceBase != s.sendNonceBase {
+			t.Fatal("both ends derived different nonce bases")
+		}
+		if c.sendNonceBase == c.recvNonceBase {
+			t.Fatal("both directions share a nonce base")
+		}
+		bases = append(bases, c.sendNonceBase, c.recvNonceBase)
+	}
+	if bases[0] == bases[2] || bases[1] == bases[3] {
+		t.Fatal("both sessions between the same keys share a nonce base")
+	}
+}
+
+// The frame the client wrote for message, as it went over the wire
+func captureFrame(t *testing.T, client, server Conn, recorded *recordingConn, message string) []byte {
+	t.Helper()
+	before := len(recorded.bytes())
+	go client.WriteMessage([]byte(message))
+	if m, err := server.ReadMessage(); err != nil || string(m) != message {
+		t.Fatal(m, err)
+	}
+	return recorded.bytes()[before:]
+}
+
+// Version 1 frames carry their own nonce, so a replayed one opens and is caught
+// by its sequence number. Later versions derive the nonce from the sequence
+// number, so the replayed header no longer opens
+func TestReplayedFrame(t *testing.T) {
+	for _, version := range []uint8{Version1, maxVersion} {
+		client, server, recorded := recordedConns(t, &Config{MaxVersion: version}, nil)
+		frame := captureFrame(t, client, server, recorded, "once")
+		if _, err := recorded.Conn.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		_, err := server.ReadMessage()
+		if version == Version1 {
+			if err != ErrSequenceMismatch {
+				t.Fatal(version, err)
+			}
+		} else if authErr, ok := err.(*AuthError); !ok || !authErr.Header || authErr.Sequence != 1 {
+			t.Fatal(version, err)
+		}
+		if _, err = server.ReadMessage(); err != ErrClosed {
+			t.Fatal(version, err)
+		}
+	}
+}
+
+// The frame the client writes for message, which never reaches the server
+func heldFrame(t *testing.T, client Conn, recorded *recordingConn, message string) []byte {
+	t.Helper()
+	recorded.hold()
+	before := len(recorded.bytes())
+	if err := client.WriteMessage([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	return recorded.bytes()[before:]
+}
+
+// What the server reads from a stream ending after cut bytes of a frame
+func readTruncated(t *testing.T, version uint8, cut int) error {
+	client, server, recorded := recordedConns(t, &Config{MaxVersion: version}, nil)
+	frame := heldFrame(t, client, recorded, "hello world")
+	if cut > len(frame) {
+		t.Fatal(cut, len(frame))
+	}
+	if _, err := recorded.Conn.Write(frame[:cut]); err != nil {
+		t.Fatal(err)
+	}
+	recorded.Conn.(*net.TCPConn).CloseWrite()
+	m, err := server.ReadMessage()
+	if err == nil && string(m) != "hello world" {
+		t.Fatal(string(m))
+	}
+	return err
+}
+
+// Only a stream ending on a frame boundary ends cleanly, and from version 5 on
+// only after a close frame
+func TestTruncatedStream(t *testing.T) {
+	for _, version := range []uint8{Version4, maxVersion} {
+		client, _, recorded := recordedConns(t, &Config{MaxVersion: version}, nil)
+		size := len(heldFrame(t, client, recorded, "hello world"))
+		for cut := 0; cut < size; cut++ {
+			err := readTruncated(t, version, cut)
+			if cut == 0 && version < Version5 {
+				if err != io.EOF {
+					t.Fatal(version, cut, err)
+				}
+			} else if err != io.ErrUnexpectedEOF {
+				t.Fatal(version, cut, err)
+			}
+		}
+		if err := readTruncated(t, version, size); err != nil {
+			t.Fatal(version, err)
+		}
+	}
+
+	client, server := testConns(t, nil, nil)
+	go func() {
+		client.WriteMessage([]byte("last"))
+		client.Close()
+	}()
+	if m, err := server.ReadMessage(); err != nil || string(m) != "last" {
+		t.Fatal(m, err)
+	}
+	if _, err := server.ReadMessage(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+// The largest payload fits in the frame size on the wire and one more byte does
+// not. Frames from version 2 on leave out the nonce the result allows for
+func TestMaxPayloadForFrame(t *testing.T) {
+	for _, tc := range []struct {
+		version uint8
+		padding uint32
+	}{{Version1, 0}, {maxVersion, 0}, {maxVersion, 64}, {maxVersion, 1000}} {
+		client, _, recorded := recordedConns(t, &Config{MaxVersion: tc.version, Padding: tc.padding}, nil)
+		nonceSize := 0
+		if tc.version < Version2 {
+			nonceSize = 24
+		}
+		for _, frameSize := range []int{frameOverhead + 100, 1000, 4096} {
+			payload := MaxPaddedPayloadForFrame(frameSize, tc.padding)
+			wireSize := frameSize - 24 + nonceSize
+			if payload < 0 || payload == 0 && tc.padding < 1000 {
+				t.Fatal(tc, frameSize, payload)
+			}
+			if payload > 0 {
+				if size := len(heldFrame(t, client, recorded, string(make([]byte, payload)))); size > wireSize {
+					t.Fatal(tc, frameSize, "the largest payload took", size)
+				}
+			}
+			if size := len(heldFrame(t, client, recorded, string(make([]byte, payload+1)))); size <= wireSize {
+				t.Fatal(tc, frameSize, "one more byte took", size)
+			}
+		}
+	}
+	if MaxPayloadForFrame(frameOverhead) != 0 || MaxPayloadForFrame(frameOverhead-1) != 0 || MaxPaddedPayloadForFrame(frameOverhead+3, 1) != 0 {
+		t.Fatal("frames too small for any payload")
+	}
+}
+
+func TestOversizedFrame(t *testing.T) {
+	client, server, recorded := recordedConns(t, &Config{MaxFrameSize: 1000}, nil)
+	before := len(recorded.bytes())
+	if err := client.WriteMessage(make([]byte, 1001)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatal(err)
+	}
+	if len(recorded.bytes()) != before {
+		t.Fatal("an oversized message was written")
+	}
+	if err := client.WriteMessage(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := server.ReadMessage(); err != nil || len(m) != 1000 {
+		t.Fatal(len(m), err)
+	}
+
+	// A peer ignoring the frame size it was told fails on the length field
+	client.(*conn).maxFrameSize = 2000
+	go client.WriteMessage(make([]byte, 1500))
+	if _, err := server.ReadMessage(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatal(err)
+	}
+	if _, err := server.ReadMessage(); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+// A stream cut inside the nonce only version 1 sends, or inside the sealed
+// header of any version, fails with io.ErrUnexpectedEOF
+func TestCutInsideNonceAndHeader(t *testing.T) {
+	sealedHeader := box.Overhead + headerSize
+	for _, tc := range []struct {
+		version    uint8
+		region     string
+		start, end int
+	}{
+		{Version1, "nonce", 1, 24},
+		{Version1, "header", 24, 24 + sealedHeader},
+		{maxVersion, "header", 1, sealedHeader},
+	} {
+		for cut := tc.start; cut < tc.end; cut++ {
+			if err := readTruncated(t, tc.version, cut); err != io.ErrUnexpectedEOF {
+				t.Fatal(tc.version, tc.region, cut, err)
+			}
+		}
+	}
+
+	// The same holds for the hello
+	a, b := tcpPair(t)
+	go func() {
+		a.Write(make([]byte, 10))
+		a.Close()
+	}()
+	if _, err := Server(b, nil); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+}
+
+func TestRekeyThresholds(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config *Config
+		rekeys uint64
+	}{
+		// After the 3rd, 6th and 9th of ten messages
+		{"Frames", &Config{RekeyAfterFrames: 3}, 3},
+		// After the 4th and 8th, each crossing 1000 bytes
+		{"Bytes", &Config{RekeyAfterBytes: 1000}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := testConns(t, tc.config, nil)
+			want := randomBytes(t, 300)
+			go func() {
+				for i := 0; i < 10; i++ {
+					client.WriteMessage(want)
+				}
+			}()
+			for i := 0; i < 10; i++ {
+				if m, err := server.ReadMessage(); err != nil || string(m) != string(want) {
+					t.Fatal(i, err)
+				}
+			}
+			if sent, received := client.Stats().Rekeys, server.Stats().Rekeys; sent != tc.rekeys || received != tc.rekeys {
+				t.Fatal(sent, "rekeys sent and", received, "received")
+			}
+		})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	before := *client.(*conn).sendKey
+	if err := client.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	if *client.(*conn).sendKey == before {
+		t.Fatal("send key kept")
+	}
+	go client.WriteMessage([]byte("rekeyed"))
+	if m, err := server.ReadMessage(); err != nil || string(m) != "rekeyed" {
+		t.Fatal(string(m), err)
+	}
+	go server.WriteMessage([]byte("back"))
+	if m, err := client.ReadMessage(); err != nil || string(m) != "back" {
+		t.Fatal(string(m), err)
+	}
+	if client.Stats().Rekeys != 1 || server.Stats().Rekeys != 1 {
+		t.Fatal(client.Stats().Rekeys, server.Stats().Rekeys)
+	}
+}
+
+// Every frame on the wire seals a multiple of Padding, whatever was written
+func TestPaddedFrames(t *testing.T) {
+	const padding = 256
+	var (
+		lock  sync.Mutex
+		sizes []int
+	)
+	config := &Config{Padding: padding, OnEvent: func(e Event) {
+		if e.Type == EventFrameSent {
+			lock.Lock()
+			sizes = append(sizes, e.Size)
+			lock.Unlock()
+		}
+	}}
+	client, server := testConns(t, config, nil)
+	lengths := []int{1, 100, padding - 4, padding - 3, 1000, 5000}
+	go func() {
+		for _, n := range lengths {
+			client.WriteMessage(bytes.Repeat([]byte{'p'}, n))
+		}
+	}()
+	for _, n := range lengths {
+		if m, err := server.ReadMessage(); err != nil || !bytes.Equal(m, bytes.Repeat([]byte{'p'}, n)) {
+			t.Fatal(n, len(m), err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sizes) < len(lengths) {
+		t.Fatal(len(sizes), "frames sent")
+	}
+	for _, size := range sizes {
+		if body := size - headerSize - 2*box.Overhead; body%padding != 0 {
+			t.Fatal("sealed", body, "bytes")
+		}
+	}
+	if sizes[0] != sizes[1] || sizes[0] != sizes[2] || sizes[2] == sizes[3] {
+		t.Fatal(sizes)
+	}
+}
+
+// A randomness source stuck on the same bytes
+type repeatingReader struct{}
+
+func (repeatingReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 7
+	}
+	return len(b), nil
+}
+
+// Version 1 draws every nonce from Config.Rand
+func TestDetectNonceReuse(t *testing.T) {
+	config := testKeys(t)
+	config.Rand, config.MaxVersion, config.DetectNonceReuse = repeatingReader{}, Version1, true
+	client, server := testConns(t, config, nil)
+	go server.ReadMessage()
+	if err := client.WriteMessage([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteMessage([]byte("second")); err != ErrNonceReuse {
+		t.Fatal(err)
+	}
+}
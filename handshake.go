@@ -0,0 +1,725 @@
+package securenet
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/coderobe/ed25519/extra25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+type handshake struct {
+	oc        net.Conn
+	bRead     *bufio.Reader
+	pub       *[32]byte
+	priv      *[32]byte
+	elligator *[32]byte
+	server    bool
+	config    *Config
+
+	transcript []byte
+	version    uint8
+	aead       AEAD
+	// The server reads the client's hello before it knows whether it resumes
+	firstHello *[helloSize]byte
+	// Zero before version 6
+	peerMaxFrameSize uint32
+	// What the client sent in its first flight, only set on the server
+	earlyData []byte
+	// Fresh for every handshake from version 8 on, nil before
+	clientRandom []byte
+	serverRandom []byte
+	// From version 9 on, the codec the server offered and then the one both use, zero for none
+	compression byte
+	// The keys of Split by direction, only set by Noise handshakes
+	noiseSend, noiseRecv *[32]byte
+}
+
+// The connection performs no I/O until Handshake is called
+func newConn(oc net.Conn, pub, priv, elligator [32]byte, server bool, config *Config) *conn {
+	c := &conn{
+		Conn:         oc,
+		bufferedRead: bufio.NewReaderSize(oc, config.readBufferSize()),
+		lastRead:     make([]byte, 1),
+		privateKey:   &priv,
+		elligator:    &elligator,
+		config:       config,
+		maxFrameSize: config.maxFrameSize(),
+		chunkSize:    config.chunkSize(),
+
+		rekeyAfterBytes:  config.rekeyAfterBytes(),
+		rekeyAfterFrames: config.rekeyAfterFrames(),
+		rand:             config.rand(),
+		writeBufferSize:  config.writeBufferSize(),
+		padding:          config.padding(),
+		isServer:         server,
+		done:             make(chan struct{}),
+	}
+	if config != nil && config.DetectNonceReuse {
+		c.sentNonces = newNonceHistory()
+	}
+	if server {
+		c.ServerPublicKey = &pub
+	} else {
+		c.PublicKey = &pub
+	}
+	return c
+}
+
+// Frames need reliable ordered bytes, datagram connections are for WrapPacket.
+// This goes by the network of the local address, connections like net.Pipe
+// whose address doesn't name a known datagram network count as streams
+func isStream(oc net.Conn) bool {
+	addr := oc.LocalAddr()
+	if addr == nil {
+		return true
+	}
+	switch addr.Network() {
+	case "udp", "udp4", "udp6", "ip", "ip4", "ip6", "unixgram":
+		return false
+	}
+	return true
+}
+
+func wrap(ctx context.Context, oc net.Conn, pub, priv, elligator [32]byte, server bool, config *Config) (nc Conn, err error) {
+	c := newConn(oc, pub, priv, elligator, server, config)
+	err = c.Handshake(ctx)
+	if err != nil {
+		return
+	}
+	nc = c
+	return
+}
+
+// The client writes first and the server reads first in every handshake mode.
+// Calling Handshake again after it succeeded does nothing, after it failed it
+// returns the same error, and datagram
+// connections fail with ErrUnsupportedTransport before anything is sent.
+// Once ctx is done, pending reads and writes of the handshake fail and it
+// returns ctx.Err(), the connection can not be used after that.
+// Read and write deadlines earlier than ctx and Config.HandshakeTimeout apply
+// to the handshake too, and are restored once it returns
+func (c *conn) Handshake(ctx context.Context) (err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.handshakeComplete {
+		return
+	}
+	if c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+	defer func() {
+		c.handshakeErr = err
+	}()
+	if !isStream(c.Conn) {
+		return ErrUnsupportedTransport
+	}
+	c.event(Event{Type: EventHandshakeStart})
+
+	deadline, hasDeadline := ctx.Deadline()
+	if timeout := c.config.handshakeTimeout(); timeout > 0 {
+		if timeoutDeadline := time.Now().Add(timeout); !hasDeadline || timeoutDeadline.Before(deadline) {
+			deadline, hasDeadline = timeoutDeadline, true
+		}
+	}
+	if hasDeadline {
+		err = c.setHandshakeDeadline(deadline)
+		if err != nil {
+			return
+		}
+		defer c.restoreDeadlines()
+	}
+	defer c.watchHandshake(ctx)()
+	defer func() {
+		if err == nil {
+			return
+		}
+		// The connection may reach the deadline of ctx before ctx is done
+		if ctxDeadline, ok := ctx.Deadline(); ok && !time.Now().Before(ctxDeadline) {
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			c.Conn.Close()
+			err = ErrHandshakeTimeout
+		}
+		c.event(Event{Type: EventHandshakeFailed, Err: err})
+	}()
+
+	h := &handshake{
+		oc:        c.Conn,
+		bRead:     c.bufferedRead,
+		priv:      c.privateKey,
+		elligator: c.elligator,
+		server:    c.isServer,
+		config:    c.config,
+	}
+	if c.isServer {
+		h.pub = c.ServerPublicKey
+	} else {
+		h.pub = c.PublicKey
+	}
+	err = h.checkEarlyData()
+	if err != nil {
+		return
+	}
+	peerKey, shared, resumed, err := h.resume()
+	if err != nil {
+		return
+	}
+	noise := c.config != nil && c.config.Noise
+	if !resumed {
+		switch {
+		case noise:
+			peerKey, shared, err = h.noise()
+		case c.config != nil && c.config.Ephemeral:
+			peerKey, shared, err = h.ephemeral()
+		default:
+			peerKey, shared, err = h.static()
+		}
+		if err != nil {
+			return
+		}
+	}
+	if !noise {
+		err = h.clientFinish()
+		if err != nil {
+			return
+		}
+	}
+	bound := bindTranscript(&shared, c.config.psk(), h.transcript)
+	wipe(shared[:])
+	shared = *bound
+	wipe(bound[:])
+	c.stateLock.Lock()
+	c.resumed = resumed
+	c.earlyData = h.earlyData != nil || (!c.isServer && c.config.earlyData() != nil)
+	c.noise = noise
+	limit := h.peerMaxFrameSize
+	if noise && (limit == 0 || limit > maxNoisePayloadSize) {
+		limit = maxNoisePayloadSize
+	}
+	if limit != 0 && limit < c.maxFrameSize {
+		c.maxFrameSize = limit
+		if c.chunkSize > c.maxFrameSize {
+			c.chunkSize = c.maxFrameSize
+		}
+		if c.writeBufferSize > c.chunkSize {
+			c.writeBufferSize = c.chunkSize
+		}
+	}
+	c.stateLock.Unlock()
+	err = c.establish(&shared, &peerKey, h.version, h.aead, append(append([]byte{}, h.clientRandom...), h.serverRandom...))
+	if err != nil {
+		return
+	}
+	if noise {
+		c.useNoiseKeys(h.noiseSend, h.noiseRecv)
+	}
+	// Noise handshakes agree on no compression, as nothing but data is sent
+	if noise || h.version >= Version9 {
+		c.codecAgreed = true
+		atomic.StoreUint32(&c.peerCompression, uint32(h.compression))
+	}
+	if len(h.earlyData) > 0 {
+		c.setBuffer(h.earlyData)
+	}
+	if c.config != nil && c.config.VerifyPeer != nil {
+		err = c.config.VerifyPeer(c.ConnectionState())
+		if err != nil {
+			c.fail()
+			return
+		}
+	}
+	if keys := c.config.ticketKeys(); c.isServer && keys != nil && !noise {
+		err = c.issueTicket(keys)
+	} else if !c.isServer && !noise {
+		c.resumptionSecret = resumptionSecret(&shared)
+	}
+	return
+}
+
+// Connections from a Listener handshake on their first read or write, and close
+// the underlying connection when that fails. Others fail with ErrNotHandshaked
+func (c *conn) handshakeFirst(ctx context.Context) (err error) {
+	if !c.lazy {
+		return
+	}
+	c.stateLock.RLock()
+	complete := c.handshakeComplete
+	c.stateLock.RUnlock()
+	if complete {
+		return
+	}
+	err = c.Handshake(ctx)
+	if err != nil {
+		c.fail()
+	}
+	return
+}
+
+// The handshake and WrapWithSharedKey both end here, the conn takes over shared.
+// The random values of both hellos, if any, are mixed into the nonce bases
+func (c *conn) establish(shared, peerKey *[32]byte, version uint8, aead AEAD, randoms []byte) (err error) {
+	sendKey, recvKey := *shared, *shared
+	if version >= Version3 {
+		clientKey, serverKey := peerKey, c.ServerPublicKey
+		if !c.isServer {
+			clientKey, serverKey = c.PublicKey, peerKey
+		}
+		clientToServer := directionKey(shared, "securenet client to server", clientKey, serverKey)
+		serverToClient := directionKey(shared, "securenet server to client", clientKey, serverKey)
+		if c.isServer {
+			sendKey, recvKey = *serverToClient, *clientToServer
+		} else {
+			sendKey, recvKey = *clientToServer, *serverToClient
+		}
+		wipe(clientToServer[:])
+		wipe(serverToClient[:])
+	}
+
+	err = c.setSession(shared, &sendKey, &recvKey, peerKey, version, aead, randoms)
+	if err != nil {
+		return
+	}
+	// OnEvent may call anything taking stateLock
+	c.startKeepAlive()
+	c.event(Event{Type: EventHandshakeComplete})
+	return
+}
+
+func (c *conn) setSession(shared, sendKey, recvKey, peerKey *[32]byte, version uint8, aead AEAD, randoms []byte) (err error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.sharedKey = shared
+	c.sendKey = sendKey
+	c.recvKey = recvKey
+	c.aead = aead
+	_, err = c.sealer.get(c.aead, c.sendKey)
+	if err != nil {
+		return
+	}
+	_, err = c.opener.get(c.aead, c.recvKey)
+	if err != nil {
+		return
+	}
+	if c.isServer {
+		c.PublicKey = peerKey
+	} else {
+		c.ServerPublicKey = peerKey
+	}
+	c.version = version
+	if c.version >= Version2 {
+		clientBase, serverBase := nonceBase(shared, "securenet client nonce", randoms), nonceBase(shared, "securenet server nonce", randoms)
+		if c.isServer {
+			c.sendNonceBase, c.recvNonceBase = serverBase, clientBase
+		} else {
+			c.sendNonceBase, c.recvNonceBase = clientBase, serverBase
+		}
+	}
+	c.handshakeComplete = true
+	return
+}
+
+// Both sides exchange the representatives of their static keys
+func (h *handshake) static() (peerKey, shared [32]byte, err error) {
+	if !h.server {
+		err = h.writeHello(h.elligator, nil)
+		if err != nil {
+			return
+		}
+		if data := h.config.earlyData(); data != nil {
+			err = h.writeEarlyData(data)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	peerKey, err = h.readHello()
+	if err != nil {
+		return
+	}
+	if EqualKeys(&peerKey, h.pub) {
+		err = ErrReflectedKey
+		return
+	}
+
+	if h.server {
+		err = h.authorizeClient(&peerKey)
+		if err != nil {
+			return
+		}
+		err = h.writeHello(h.elligator, nil)
+		if err != nil {
+			return
+		}
+	} else {
+		err = h.verifyServer(&peerKey)
+		if err != nil {
+			return
+		}
+	}
+
+	box.Precompute(&shared, &peerKey, h.priv)
+	return
+}
+
+// Both sides exchange the representatives of fresh ephemeral keys, then the
+// server sends its static key sealed under ee and the client sends its static
+// key sealed under ee and es. The session key mixes ee, es and se, so only the
+// holders of both static private keys can derive it, and it can not be
+// recovered from the static keys once the ephemeral keys are gone
+func (h *handshake) ephemeral() (peerKey, shared [32]byte, err error) {
+	ePub, ePriv, eElligator, err := GenerateKeysWithRand(h.config.rand())
+	if err != nil {
+		return
+	}
+	var ee, es, se [32]byte
+	defer func() {
+		wipe(ePriv[:])
+		wipe(ee[:])
+		wipe(es[:])
+		wipe(se[:])
+	}()
+
+	if !h.server {
+		err = h.writeHello(&eElligator, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	peerEphemeral, err := h.readHello()
+	if err != nil {
+		return
+	}
+	if EqualKeys(&peerEphemeral, &ePub) {
+		err = ErrReflectedKey
+		return
+	}
+
+	box.Precompute(&ee, &peerEphemeral, &ePriv)
+	serverNonce, clientNonce := new([24]byte), new([24]byte)
+	clientNonce[0] = 1
+
+	if h.server {
+		err = h.writeHello(&eElligator, box.SealAfterPrecomputation(nil, h.pub[:], serverNonce, &ee))
+		if err != nil {
+			return
+		}
+		box.Precompute(&es, &peerEphemeral, h.priv)
+
+		clientKey := mixKeys("securenet client static", &ee, &es)
+		defer wipe(clientKey[:])
+		peerKey, err = h.readSealedKey(clientNonce, clientKey)
+		if err != nil {
+			return
+		}
+		err = h.authorizeClient(&peerKey)
+		if err != nil {
+			return
+		}
+		box.Precompute(&se, &peerKey, &ePriv)
+	} else {
+		peerKey, err = h.readSealedKey(serverNonce, &ee)
+		if err != nil {
+			return
+		}
+		err = h.verifyServer(&peerKey)
+		if err != nil {
+			return
+		}
+		box.Precompute(&es, &peerKey, &ePriv)
+
+		clientKey := mixKeys("securenet client static", &ee, &es)
+		defer wipe(clientKey[:])
+		sealed := box.SealAfterPrecomputation(nil, h.pub[:], clientNonce, clientKey)
+		err = writeFull(h.oc, sealed)
+		if err != nil {
+			return
+		}
+		box.Precompute(&se, &peerEphemeral, h.priv)
+	}
+
+	shared = *mixKeys("securenet ephemeral", &ee, &es, &se)
+	return
+}
+
+// A hello is a representative followed by the highest protocol version the sender supports,
+// from version 4 on the server's is followed by the ID of the AEAD it picked,
+// from version 6 on by its MaxFrameSize as 4 little endian bytes, from
+// version 8 on by 32 random bytes and from version 9 on by the ID of its
+// compression codec, zero for none.
+// Both hellos make up the transcript the session key is bound to, so the
+// first frame fails to open if either version byte or the ID was tampered with
+func (h *handshake) writeHello(elligator *[32]byte, extra []byte) (err error) {
+	hello := append(append([]byte{}, elligator[:]...), h.config.maxVersion())
+	if !h.server && h.config.earlyData() != nil {
+		hello[32] |= earlyFlag
+	}
+	if h.server && h.version >= Version4 {
+		hello = append(hello, h.aead.ID())
+	}
+	if h.server && h.version >= Version6 {
+		hello = appendFrameSize(hello, h.config)
+	}
+	if h.server && h.version >= Version8 {
+		h.serverRandom, err = h.random()
+		if err != nil {
+			return
+		}
+		hello = append(hello, h.serverRandom...)
+	}
+	if h.server && h.version >= Version9 {
+		hello = append(hello, h.config.compressionID())
+	}
+	h.transcript = append(h.transcript, hello...)
+	return writeFull(h.oc, append(hello, extra...))
+}
+
+// The negotiated version is the lower of both sides' highest supported versions
+func (h *handshake) readHello() (peerKey [32]byte, err error) {
+	var hello [33]byte
+	if h.firstHello != nil {
+		hello, h.firstHello = *h.firstHello, nil
+	} else {
+		_, err = io.ReadFull(h.bRead, hello[:])
+		if err != nil {
+			return
+		}
+	}
+	h.transcript = append(h.transcript, hello[:]...)
+	early := h.server && hello[32]&earlyFlag != 0
+	if h.server {
+		hello[32] &^= earlyFlag
+	}
+	peerKey, h.version, err = parseHello(&hello, h.config)
+	if err != nil {
+		return
+	}
+	if early {
+		err = h.readEarlyData(&peerKey)
+		if err != nil {
+			return
+		}
+	}
+	h.aead = NaClBox
+	if h.version < Version4 {
+		return
+	}
+	if h.server {
+		h.aead = h.config.aead()
+		return
+	}
+	var id [1]byte
+	_, err = io.ReadFull(h.bRead, id[:])
+	if err != nil {
+		return
+	}
+	h.transcript = append(h.transcript, id[0])
+	h.aead, err = clientAEAD(id[0], h.config)
+	if err != nil || h.version < Version6 {
+		return
+	}
+	err = h.readFrameSize()
+	if err != nil || h.version < Version8 {
+		return
+	}
+	h.serverRandom, err = h.readRandom()
+	if err != nil || h.version < Version9 {
+		return
+	}
+	err = h.readCompression()
+	return
+}
+
+func (h *handshake) readCompression() (err error) {
+	var id [1]byte
+	_, err = io.ReadFull(h.bRead, id[:])
+	if err != nil {
+		return
+	}
+	h.transcript = append(h.transcript, id[0])
+	h.compression = id[0]
+	return
+}
+
+func (h *handshake) random() (random []byte, err error) {
+	random = make([]byte, 32)
+	_, err = io.ReadFull(h.config.rand(), random)
+	return
+}
+
+func (h *handshake) readRandom() (random []byte, err error) {
+	random = make([]byte, 32)
+	_, err = io.ReadFull(h.bRead, random)
+	if err != nil {
+		return nil, err
+	}
+	h.transcript = append(h.transcript, random...)
+	return
+}
+
+func appendFrameSize(b []byte, config *Config) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], config.maxFrameSize())
+	return append(b, size[:]...)
+}
+
+func (h *handshake) readFrameSize() (err error) {
+	var size [4]byte
+	_, err = io.ReadFull(h.bRead, size[:])
+	if err != nil {
+		return
+	}
+	h.transcript = append(h.transcript, size[:]...)
+	h.peerMaxFrameSize = binary.LittleEndian.Uint32(size[:])
+	if h.peerMaxFrameSize == 0 {
+		err = fmt.Errorf("%w: peer accepts no frames", ErrHandshake)
+	}
+	return
+}
+
+// From version 6 on the client sends its MaxFrameSize once it read the server's,
+// from version 8 on its random value unless the resumption messages carried
+// one, and from version 9 on the codec the server offered if it uses the same,
+// zero otherwise, so servers of earlier versions never see any of these
+func (h *handshake) clientFinish() (err error) {
+	if h.version < Version6 {
+		return
+	}
+	random := h.version >= Version8 && h.clientRandom == nil
+	if h.server {
+		err = h.readFrameSize()
+		if err != nil {
+			return
+		}
+		if random {
+			h.clientRandom, err = h.readRandom()
+			if err != nil {
+				return
+			}
+		}
+		if h.version < Version9 {
+			return
+		}
+		err = h.readCompression()
+		if err == nil && h.compression != 0 && h.compression != h.config.compressionID() {
+			err = fmt.Errorf("%w: client picked codec %d", ErrHandshake, h.compression)
+		}
+		return
+	}
+	msg := appendFrameSize(nil, h.config)
+	if random {
+		h.clientRandom, err = h.random()
+		if err != nil {
+			return
+		}
+		msg = append(msg, h.clientRandom...)
+	}
+	if h.version >= Version9 {
+		if h.compression != h.config.compressionID() {
+			h.compression = 0
+		}
+		msg = append(msg, h.compression)
+	}
+	h.transcript = append(h.transcript, msg...)
+	return writeFull(h.oc, msg)
+}
+
+func parseHello(hello *[33]byte, config *Config) (peerKey [32]byte, version uint8, err error) {
+	version = hello[32]
+	if local := config.maxVersion(); version > local {
+		version = local
+	}
+	if version < minVersion {
+		err = fmt.Errorf("%w: peer supports up to version %d", ErrUnsupportedVersion, hello[32])
+		return
+	}
+
+	var peerKeyElligator [32]byte
+	copy(peerKeyElligator[:], hello[:32])
+	maskRepresentative(&peerKeyElligator)
+	if !isValidRepresentative(&peerKeyElligator) {
+		err = ErrInvalidRepresentative
+		return
+	}
+	extra25519.RepresentativeToPublicKey(&peerKey, &peerKeyElligator)
+	if isLowOrder(&peerKey) {
+		err = ErrInvalidPeerKey
+	}
+	return
+}
+
+func (h *handshake) readSealedKey(nonce *[24]byte, key *[32]byte) (peerKey [32]byte, err error) {
+	sealed := make([]byte, 32+box.Overhead)
+	_, err = io.ReadFull(h.bRead, sealed)
+	if err != nil {
+		return
+	}
+	opened, success := box.OpenAfterPrecomputation(nil, sealed, nonce, key)
+	if !success {
+		err = fmt.Errorf("%w: sealed static key does not open", ErrHandshake)
+		return
+	}
+	copy(peerKey[:], opened)
+	if isLowOrder(&peerKey) {
+		err = ErrInvalidPeerKey
+	}
+	return
+}
+
+func (h *handshake) verifyServer(peerKey *[32]byte) (err error) {
+	if h.config != nil && h.config.ServerPublicKey != nil {
+		if !EqualKeys(peerKey, h.config.ServerPublicKey) {
+			err = ErrServerKeyMismatch
+		}
+	}
+	return
+}
+
+func (h *handshake) authorizeClient(peerKey *[32]byte) (err error) {
+	if h.config != nil && h.config.AuthorizeClient != nil && !h.config.AuthorizeClient(peerKey) {
+		h.oc.Close()
+		err = ErrClientNotAuthorized
+	}
+	return
+}
+
+// The pre-shared key, if any, is the HKDF salt
+func bindTranscript(key *[32]byte, psk []byte, transcript []byte) *[32]byte {
+	bound := new([32]byte)
+	info := append([]byte("securenet transcript"), transcript...)
+	io.ReadFull(hkdf.New(sha256.New, key[:], psk, info), bound[:])
+	return bound
+}
+
+// The info is the label followed by the client's and the server's static public keys
+func directionKey(shared *[32]byte, label string, clientKey, serverKey *[32]byte) *[32]byte {
+	key := new([32]byte)
+	info := append(append([]byte(label), clientKey[:]...), serverKey[:]...)
+	io.ReadFull(hkdf.New(sha256.New, shared[:], nil, info), key[:])
+	return key
+}
+
+func mixKeys(label string, keys ...*[32]byte) *[32]byte {
+	var secret []byte
+	for _, key := range keys {
+		secret = append(secret, key[:]...)
+	}
+	mixed := new([32]byte)
+	io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(label)), mixed[:])
+	return mixed
+}
@@ -0,0 +1,292 @@
+package securenet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Everything the client writes over a fresh connection between the same static
+// keys, up to and including the message
+func staticSession(t *testing.T, clientConfig, serverConfig *Config, message []byte) (written, exported []byte) {
+	a, b := tcpPair(t)
+	recorded := &recordingConn{Conn: a}
+	done := make(chan error, 1)
+	go func() {
+		server, err := Server(b, serverConfig)
+		if err == nil {
+			_, err = server.ReadMessage()
+			server.Close()
+		}
+		done <- err
+	}()
+	client, err := Client(recorded, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	exported, err = client.ExportKeyingMaterial("test", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.WriteMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return recorded.bytes(), exported
+}
+
+func TestStaticSessionsAreFresh(t *testing.T) {
+	clientConfig, serverConfig := testKeys(t), testKeys(t)
+	message := []byte("the same message on both connections")
+	first, firstKey := staticSession(t, clientConfig, serverConfig, message)
+	second, secondKey := staticSession(t, clientConfig, serverConfig, message)
+	if bytes.Equal(firstKey, secondKey) {
+		t.Fatal("both sessions derived the same session key")
+	}
+	if bytes.Equal(first[helloSize:], second[helloSize:]) {
+		t.Fatal("both sessions sent the same bytes after the hello")
+	}
+}
+
+func TestVersion7Peer(t *testing.T) {
+	clientConfig := &Config{MaxVersion: Version7}
+	client, server := testConns(t, clientConfig, nil)
+	if client.ConnectionState().Version != Version7 || server.ConnectionState().Version != Version7 {
+		t.Fatal(client.ConnectionState().Version, server.ConnectionState().Version)
+	}
+	go client.WriteMessage([]byte("hello"))
+	m, err := server.ReadMessage()
+	if err != nil || string(m) != "hello" {
+		t.Fatal(m, err)
+	}
+}
+
+// The all-zero representative maps to the all-zero key
+func TestLowOrderPeerKey(t *testing.T) {
+	var zeroHello [helloSize]byte
+	zeroHello[32] = maxVersion
+
+	a, b := tcpPair(t)
+	defer a.Close()
+	go a.Write(zeroHello[:])
+	if _, err := Server(b, nil); err != ErrInvalidPeerKey {
+		t.Fatal("server", err)
+	}
+
+	a, b = tcpPair(t)
+	defer b.Close()
+	go func() {
+		io.ReadFull(b, make([]byte, helloSize))
+		b.Write(zeroHello[:])
+	}()
+	if _, err := Client(a, nil); err != ErrInvalidPeerKey {
+		t.Fatal("client", err)
+	}
+}
+
+func TestLowOrderRehandshakeKey(t *testing.T) {
+	for _, point := range lowOrderPoints {
+		for _, highBit := range []byte{0, 0x80} {
+			key := point
+			key[31] |= highBit
+			if !isLowOrder(&key) {
+				t.Fatal(key)
+			}
+			client, server := testConns(t, nil, nil)
+			if err := client.(*conn).writeControl(frameRehandshakeRequest, key[:]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := server.ReadMessage(); err != ErrInvalidPeerKey {
+				t.Fatal(key, err)
+			}
+		}
+	}
+	pub, _, _, err := GenerateKeys()
+	if err != nil || isLowOrder(&pub) {
+		t.Fatal(pub, err)
+	}
+}
+
+// Representatives above (p - 1) / 2 are not produced by elligator 2, whatever
+// the top two bits hold
+func TestMalformedRepresentative(t *testing.T) {
+	aboveHalf := halfPMinus1
+	aboveHalf[0]++
+	allOnes := [32]byte{}
+	for i := range allOnes {
+		allOnes[i] = 0xff
+	}
+	highBits := aboveHalf
+	highBits[31] |= 0xc0
+	for _, representative := range [][32]byte{aboveHalf, allOnes, highBits} {
+		masked := representative
+		maskRepresentative(&masked)
+		if isValidRepresentative(&masked) {
+			t.Fatal(representative)
+		}
+		a, b := tcpPair(t)
+		go a.Write(append(representative[:], maxVersion))
+		if _, err := Server(b, nil); err != ErrInvalidRepresentative {
+			t.Fatal(representative, err)
+		}
+		a.Close()
+	}
+
+	boundary := halfPMinus1
+	if !isValidRepresentative(&boundary) {
+		t.Fatal("the largest representative was rejected")
+	}
+	_, priv, elligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	elligator[0] ^= 1
+	if _, _, _, err = (&Config{PrivateKey: &priv, Representative: &elligator}).keys(); err != ErrInvalidRepresentative {
+		t.Fatal(err)
+	}
+}
+
+func TestReflectedKey(t *testing.T) {
+	config := testKeys(t)
+
+	a, b := tcpPair(t)
+	go a.Write(append(config.Representative[:], maxVersion))
+	if _, err := Server(b, config); err != ErrReflectedKey {
+		t.Fatal("server", err)
+	}
+	a.Close()
+
+	a, b = tcpPair(t)
+	go func() {
+		// Version 3 hellos carry nothing after the version byte
+		hello := make([]byte, helloSize)
+		if _, err := io.ReadFull(b, hello); err == nil {
+			hello[32] = Version3
+			b.Write(hello)
+		}
+	}()
+	if _, err := Client(a, config); err != ErrReflectedKey {
+		t.Fatal("client", err)
+	}
+	b.Close()
+}
+
+// The handshake leaves the deadlines the caller set, and those earlier than its
+// own still apply to it
+func TestHandshakeKeepsDeadlines(t *testing.T) {
+	l := testListener(t, &Config{HandshakeTimeout: 10 * time.Second})
+	dialed := make(chan Conn, 1)
+	go func() {
+		c, _ := Dial("tcp", l.Addr().String())
+		dialed <- c
+	}()
+	c, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	// The first read runs the handshake, then waits for data that never comes
+	if _, err = c.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatal(err)
+	}
+	if client := <-dialed; client == nil {
+		t.Fatal("dial failed")
+	} else {
+		defer client.Close()
+	}
+
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	c, err = l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err = c.Read(make([]byte, 1)); !isTimeout(err) || time.Since(start) > 5*time.Second {
+		t.Fatal(err, time.Since(start))
+	}
+}
+
+// Both ends of a handshake that is expected to fail
+func failedHandshake(t *testing.T, clientConfig, serverConfig *Config) (clientErr, serverErr error) {
+	t.Helper()
+	a, b := tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Server(b, serverConfig)
+		b.Close()
+		done <- err
+	}()
+	_, clientErr = Client(a, clientConfig)
+	a.Close()
+	return clientErr, <-done
+}
+
+// The handshakes checking the peer's static key
+var keyCheckModes = []struct {
+	name  string
+	apply func(c *Config)
+}{
+	{"Static", func(c *Config) {}},
+	{"Ephemeral", func(c *Config) { c.Ephemeral = true }},
+	{"Noise", func(c *Config) { c.Noise = true }},
+}
+
+func TestServerKeyMismatch(t *testing.T) {
+	for _, mode := range keyCheckModes {
+		t.Run(mode.name, func(t *testing.T) {
+			clientConfig, serverConfig := pinnedConfigs(t)
+			mode.apply(clientConfig)
+			mode.apply(serverConfig)
+			testConns(t, clientConfig, serverConfig)
+
+			other, _, _, err := GenerateKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.ServerPublicKey = &other
+			if err, _ = failedHandshake(t, clientConfig, serverConfig); !errors.Is(err, ErrServerKeyMismatch) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClientNotAuthorized(t *testing.T) {
+	for _, mode := range keyCheckModes {
+		t.Run(mode.name, func(t *testing.T) {
+			clientConfig, serverConfig := testKeys(t), testKeys(t)
+			mode.apply(clientConfig)
+			mode.apply(serverConfig)
+			var authorized [32]byte
+			serverConfig.AuthorizeClient = func(pub *[32]byte) bool {
+				authorized = *pub
+				return true
+			}
+			client, _ := testConns(t, clientConfig, serverConfig)
+			if authorized != client.ConnectionState().LocalPublicKey {
+				t.Fatal("another key authorized")
+			}
+
+			serverConfig.AuthorizeClient = func(pub *[32]byte) bool { return false }
+			if _, err := failedHandshake(t, clientConfig, serverConfig); !errors.Is(err, ErrClientNotAuthorized) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package securenet
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// Requests must use http:// URLs, securenet takes the place of TLS.
+// Every connection requires the server to present serverKey, serve with
+// http.Serve on a Listener from Listen or ListenWithConfig
+func NewHTTPTransport(serverKey [32]byte) *http.Transport {
+	dialer := &Dialer{ServerPublicKey: &serverKey}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
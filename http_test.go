@@ -0,0 +1,55 @@
+package securenet
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type connKey struct{}
+
+func TestHTTPTransport(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(connKey{}).(Conn); !ok {
+			w.Write([]byte("plain"))
+			return
+		}
+		w.Write([]byte("secure " + r.URL.Path))
+	}))
+	srv.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, c)
+	}
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewHTTPTransport(*l.GetPublicKey())}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(srv.URL + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "secure /path" {
+		t.Fatal(string(body), err)
+	}
+
+	other, _, _, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := &http.Client{Transport: NewHTTPTransport(other)}
+	if _, err = pinned.Get(srv.URL); !errors.Is(err, ErrServerKeyMismatch) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,118 @@
+package securenet
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// The ticker runs at half the shorter of both durations, so keepalives and
+// timeouts fire at most that much later than configured. The peer only times
+// out while a read waits for it, data the application has not read yet does
+// not count against it. The Noise transport sends no keepalives
+func (c *conn) startKeepAlive() {
+	interval, timeout := c.config.keepAlive()
+	if c.noise {
+		interval = 0
+	}
+	if interval <= 0 && timeout <= 0 {
+		return
+	}
+	tick := interval
+	if tick <= 0 || (timeout > 0 && timeout < tick) {
+		tick = timeout
+	}
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&c.lastSent, now)
+	atomic.StoreInt64(&c.lastReceived, now)
+	go c.keepAlive(interval, timeout, tick/2)
+}
+
+func (c *conn) keepAlive(interval, timeout, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if timeout > 0 && atomic.LoadInt32(&c.reading) == 1 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastReceived))) >= timeout {
+				atomic.StoreInt32(&c.peerTimedOut, 1)
+				c.Conn.Close()
+				return
+			}
+			if interval > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastSent))) >= interval {
+				err := c.writeControl(frameKeepAlive, nil)
+				if err != nil && err != ErrWriteClosed {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Pongs and keepalive acknowledgements waiting to be sent
+const maxPendingReplies = 16
+
+// Control frames are sent outside of Write, so they must not report errors to its callers
+func (c *conn) writeControl(frameType byte, b []byte) (err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.writeRawFrame(frameType, b)
+}
+
+// The pong is only read while a read is pending on this connection, such as
+// a goroutine blocked in Read or WriteTo. Concurrent pings are matched by ID.
+// After a Noise handshake this fails with ErrNoiseTransport
+func (c *conn) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	err = c.handshakeFirst(ctx)
+	if err != nil {
+		return
+	}
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], atomic.AddUint64(&c.pingID, 1))
+	pong := make(chan struct{})
+	c.pingLock.Lock()
+	if c.pings == nil {
+		c.pings = make(map[[8]byte]chan struct{})
+	}
+	c.pings[id] = pong
+	c.pingLock.Unlock()
+	defer func() {
+		c.pingLock.Lock()
+		delete(c.pings, id)
+		c.pingLock.Unlock()
+	}()
+
+	start := time.Now()
+	err = c.writeControl(framePing, id[:])
+	if err != nil {
+		return
+	}
+	select {
+	case <-pong:
+		rtt = time.Since(start)
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.done:
+		err = ErrClosed
+	}
+	return
+}
+
+func (c *conn) handlePong(b []byte) (err error) {
+	var id [8]byte
+	if len(b) != len(id) {
+		return fmt.Errorf("%w: pong frame of %d bytes", ErrMalformedFrame, len(b))
+	}
+	copy(id[:], b)
+	c.pingLock.Lock()
+	defer c.pingLock.Unlock()
+	if pong, ok := c.pings[id]; ok {
+		close(pong)
+		delete(c.pings, id)
+	}
+	return
+}
@@ -0,0 +1,65 @@
+package securenet
+
+import (
+	"context"
+	"encoding/binary"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPingFloodIsBounded(t *testing.T) {
+	client, server := pipeConns(t, nil, nil)
+	before := runtime.NumGoroutine()
+	go func() {
+		for i := 0; i < 2000; i++ {
+			var id [8]byte
+			binary.LittleEndian.PutUint64(id[:], uint64(i))
+			client.(*conn).writeControl(framePing, id[:])
+			client.(*conn).writeControl(frameKeepAlive, nil)
+		}
+		client.WriteMessage([]byte("done"))
+	}()
+	m, err := server.ReadMessage()
+	if err != nil || string(m) != "done" {
+		t.Fatal(m, err)
+	}
+	if grown := runtime.NumGoroutine() - before; grown > 5 {
+		t.Fatalf("%d goroutines left behind by the flood", grown)
+	}
+}
+
+func TestPing(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	go server.ReadMessage()
+	go client.ReadMessage()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		rtt, err := client.Ping(ctx)
+		if err != nil || rtt <= 0 {
+			t.Fatal(rtt, err)
+		}
+	}
+}
+
+// The peer's keepalives waiting unread in the socket keep it alive
+func TestKeepAliveWhileNotReading(t *testing.T) {
+	client, server := testConns(t, &Config{KeepAliveTimeout: 150 * time.Millisecond}, &Config{KeepAliveInterval: 30 * time.Millisecond})
+	time.Sleep(500 * time.Millisecond)
+	go server.WriteMessage([]byte("still here"))
+	if m, err := client.ReadMessage(); err != nil || string(m) != "still here" {
+		t.Fatal(m, err)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	client, _ := testConns(t, &Config{KeepAliveTimeout: 100 * time.Millisecond}, nil)
+	start := time.Now()
+	if _, err := client.ReadMessage(); err != ErrKeepAliveTimeout {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatal("timed out after", elapsed)
+	}
+}
@@ -0,0 +1,240 @@
+package securenet
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/coderobe/ed25519/extra25519"
+	"golang.org/x/crypto/argon2"
+)
+
+// The same seed always yields the same keypair, so the seed must be kept as secret as the private key
+func GenerateKeysFromSeed(seed []byte) (pub, priv, elligator [32]byte, err error) {
+	return GenerateKeysWithRand(&seedReader{seed: seed})
+}
+
+// Memory is in KiB, see golang.org/x/crypto/argon2 for choosing these
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// The parameters golang.org/x/crypto/argon2 recommends for IDKey
+var DefaultArgon2Params = Argon2Params{Time: 1, Memory: 64 << 10, Threads: 4}
+
+// The password is stretched with Argon2id into a seed for GenerateKeysFromSeed.
+// The same password, salt and params always yield the same keypair, so the salt
+// and params must be kept alongside and should be 16 or more random bytes.
+// Anyone guessing the password gets the private key, a weak password makes a weak identity
+func GenerateKeysFromPassword(password, salt []byte, params Argon2Params) (pub, priv, elligator [32]byte, err error) {
+	if params.Time == 0 || params.Memory == 0 || params.Threads == 0 {
+		err = fmt.Errorf("%w: %+v", ErrInvalidParams, params)
+		return
+	}
+	seed := argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, 32)
+	defer wipe(seed)
+	return GenerateKeysFromSeed(seed)
+}
+
+// This takes the same time for any two keys, so it is safe for comparing a
+// peer's key against a secret or pinned one. A nil key only equals a nil key
+func EqualKeys(a, b *[32]byte) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// This expands a seed into SHA-256(label || counter || seed) blocks
+type seedReader struct {
+	seed    []byte
+	counter uint64
+	block   []byte
+}
+
+func (r *seedReader) Read(b []byte) (n int, err error) {
+	for n < len(b) {
+		if len(r.block) == 0 {
+			h := sha256.New()
+			h.Write([]byte("securenet seed"))
+			binary.Write(h, binary.LittleEndian, r.counter)
+			h.Write(r.seed)
+			r.block = h.Sum(nil)
+			r.counter++
+		}
+		copied := copy(b[n:], r.block)
+		r.block = r.block[copied:]
+		n += copied
+	}
+	return
+}
+
+// Keys are encoded as unpadded URL-safe base64
+func EncodePublicKey(pub *[32]byte) string {
+	return base64.RawURLEncoding.EncodeToString(pub[:])
+}
+
+func ParsePublicKey(s string) (*[32]byte, error) {
+	return parseKey(s, base64.RawURLEncoding.DecodeString)
+}
+
+func EncodePublicKeyHex(pub *[32]byte) string {
+	return hex.EncodeToString(pub[:])
+}
+
+func ParsePublicKeyHex(s string) (*[32]byte, error) {
+	return parseKey(s, hex.DecodeString)
+}
+
+func EncodePrivateKey(priv *[32]byte) string {
+	return base64.RawURLEncoding.EncodeToString(priv[:])
+}
+
+func ParsePrivateKey(s string) (*[32]byte, error) {
+	return parseKey(s, base64.RawURLEncoding.DecodeString)
+}
+
+func EncodePrivateKeyHex(priv *[32]byte) string {
+	return hex.EncodeToString(priv[:])
+}
+
+func ParsePrivateKeyHex(s string) (*[32]byte, error) {
+	return parseKey(s, hex.DecodeString)
+}
+
+func parseKey(s string, decode func(string) ([]byte, error)) (key *[32]byte, err error) {
+	decoded, err := decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if len(decoded) != 32 {
+		return nil, fmt.Errorf("%w: decoded to %d bytes", ErrInvalidKey, len(decoded))
+	}
+	key = new([32]byte)
+	copy(key[:], decoded)
+	wipe(decoded)
+	return
+}
+
+const (
+	privateKeyPEMType = "SECURENET PRIVATE KEY"
+	publicKeyPEMType  = "SECURENET PUBLIC KEY"
+)
+
+// The block holds the private key followed by its representative
+func MarshalPrivateKeyPEM(priv, elligator *[32]byte) []byte {
+	block := make([]byte, 0, 64)
+	block = append(append(block, priv[:]...), elligator[:]...)
+	defer wipe(block)
+	return pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: block})
+}
+
+// The representative must be the one GenerateKeys derived for the private key
+func ParsePrivateKeyPEM(data []byte) (priv, elligator *[32]byte, err error) {
+	block, err := decodePEM(data, privateKeyPEMType, 64)
+	if err != nil {
+		return
+	}
+	defer wipe(block)
+	priv, elligator = new([32]byte), new([32]byte)
+	copy(priv[:], block)
+	copy(elligator[:], block[32:])
+	var pub, derived [32]byte
+	if !extra25519.ScalarBaseMult(&pub, &derived, priv) || !EqualKeys(&derived, elligator) {
+		wipe(priv[:])
+		priv, elligator = nil, nil
+		err = fmt.Errorf("%w: representative does not belong to the private key", ErrInvalidKey)
+	}
+	return
+}
+
+func MarshalPublicKeyPEM(pub *[32]byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: pub[:]})
+}
+
+func ParsePublicKeyPEM(data []byte) (pub *[32]byte, err error) {
+	block, err := decodePEM(data, publicKeyPEMType, 32)
+	if err != nil {
+		return
+	}
+	pub = new([32]byte)
+	copy(pub[:], block)
+	return
+}
+
+// Only the first block is decoded, data after it is ignored
+func decodePEM(data []byte, blockType string, size int) (decoded []byte, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrInvalidKey)
+	}
+	if block.Type != blockType {
+		wipe(block.Bytes)
+		return nil, fmt.Errorf("%w: PEM block of type %q", ErrInvalidKey, block.Type)
+	}
+	if len(block.Bytes) != size {
+		wipe(block.Bytes)
+		return nil, fmt.Errorf("%w: PEM block of %d bytes", ErrInvalidKey, len(block.Bytes))
+	}
+	return block.Bytes, nil
+}
+
+// This renders the first 16 bytes of SHA-256(pub) as colon separated groups of four hex digits
+func Fingerprint(pub *[32]byte) string {
+	sum := sha256.Sum256(pub[:])
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// Points of small order on curve25519 and their non-canonical encodings, compared with the high bit masked
+var lowOrderPoints = [][32]byte{
+	{},
+	{0x01},
+	{0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a, 0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00},
+	{0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b, 0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57},
+	{0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	{0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	{0xee, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+}
+
+// Low order keys force a predictable shared secret
+func isLowOrder(pub *[32]byte) bool {
+	masked := *pub
+	masked[31] &= 0x7f
+	found := 0
+	for _, point := range lowOrderPoints {
+		found |= subtle.ConstantTimeCompare(masked[:], point[:])
+	}
+	return found == 1
+}
+
+// (p - 1) / 2 for p = 2^255 - 19, little endian
+var halfPMinus1 = [32]byte{0xf6, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x3f}
+
+// Elligator 2 only produces representatives in [0, (p - 1) / 2], so the top two
+// bits carry nothing. Encoders that fill them with random bits to look uniform
+// are read the same as ours, which leave them clear
+func maskRepresentative(elligator *[32]byte) {
+	elligator[31] &= 0x3f
+}
+
+// Elligator 2 only produces representatives in [0, (p - 1) / 2], callers mask the top two bits first
+func isValidRepresentative(elligator *[32]byte) bool {
+	for i := 31; i >= 0; i-- {
+		if elligator[i] != halfPMinus1[i] {
+			return elligator[i] < halfPMinus1[i]
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package securenet
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/coderobe/ed25519/extra25519"
+)
+
+func TestPEMRoundTrip(t *testing.T) {
+	pub, priv, elligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedPriv, parsedElligator, err := ParsePrivateKeyPEM(MarshalPrivateKeyPEM(&priv, &elligator))
+	if err != nil || *parsedPriv != priv || *parsedElligator != elligator {
+		t.Fatal(err)
+	}
+	parsedPub, err := ParsePublicKeyPEM(MarshalPublicKeyPEM(&pub))
+	if err != nil || *parsedPub != pub {
+		t.Fatal(err)
+	}
+}
+
+func TestMalformedPEM(t *testing.T) {
+	pub, priv, elligator, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherElligator := elligator
+	otherElligator[0] ^= 1
+	pair := append(append([]byte{}, priv[:]...), elligator[:]...)
+
+	for name, data := range map[string][]byte{
+		"empty":                nil,
+		"garbage":              []byte("garbage"),
+		"public as private":    MarshalPublicKeyPEM(&pub),
+		"short":                pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: pair[:63]}),
+		"long":                 pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: append(pair, 0)}),
+		"wrong type":           pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pair}),
+		"other representative": MarshalPrivateKeyPEM(&priv, &otherElligator),
+	} {
+		if priv, elligator, err := ParsePrivateKeyPEM(data); !errors.Is(err, ErrInvalidKey) || priv != nil || elligator != nil {
+			t.Fatal(name, err)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":             nil,
+		"private as public": MarshalPrivateKeyPEM(&priv, &elligator),
+		"short":             pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: pub[:31]}),
+	} {
+		if pub, err := ParsePublicKeyPEM(data); !errors.Is(err, ErrInvalidKey) || pub != nil {
+			t.Fatal(name, err)
+		}
+	}
+}
+
+// Representatives map back to the key they were made from, whatever the top two
+// bits hold
+func TestRepresentativeRoundTrip(t *testing.T) {
+	for i := 0; i < 64; i++ {
+		pub, priv, elligator, err := GenerateKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elligator[31]&0xc0 != 0 {
+			t.Fatal("top bits set in", elligator)
+		}
+		var mapped [32]byte
+		extra25519.RepresentativeToPublicKey(&mapped, &elligator)
+		if mapped != pub {
+			t.Fatal("representative maps to", mapped, "not", pub)
+		}
+		for _, topBits := range []byte{0x40, 0x80, 0xc0} {
+			var hello [helloSize]byte
+			copy(hello[:], elligator[:])
+			hello[31] |= topBits
+			hello[32] = maxVersion
+			peerKey, _, err := parseHello(&hello, nil)
+			if err != nil || peerKey != pub {
+				t.Fatal(topBits, err)
+			}
+
+			filled := elligator
+			filled[31] |= topBits
+			configPub, _, configElligator, err := (&Config{PrivateKey: &priv, Representative: &filled}).keys()
+			if err != nil || configPub != pub || configElligator != elligator {
+				t.Fatal(topBits, err)
+			}
+		}
+	}
+}
+
+// The representative of a generated keypair maps back to its public key
+func checkKeypair(t *testing.T, pub, elligator [32]byte) {
+	t.Helper()
+	var mapped [32]byte
+	extra25519.RepresentativeToPublicKey(&mapped, &elligator)
+	if mapped != pub {
+		t.Fatal("representative maps to another key")
+	}
+}
+
+func TestGenerateKeysFromSeed(t *testing.T) {
+	pub, priv, elligator, err := GenerateKeysFromSeed([]byte("seed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeypair(t, pub, elligator)
+	samePub, samePriv, sameElligator, err := GenerateKeysFromSeed([]byte("seed"))
+	if err != nil || samePub != pub || samePriv != priv || sameElligator != elligator {
+		t.Fatal("the same seed gave another keypair", err)
+	}
+	otherPub, _, _, err := GenerateKeysFromSeed([]byte("other seed"))
+	if err != nil || otherPub == pub {
+		t.Fatal("another seed gave the same keypair", err)
+	}
+}
+
+func TestGenerateKeysFromPassword(t *testing.T) {
+	// Cheap parameters, this tests the derivation and not its strength
+	params := Argon2Params{Time: 1, Memory: 64, Threads: 1}
+	salt := []byte("sixteen byte salt")
+	pub, priv, elligator, err := GenerateKeysFromPassword([]byte("password"), salt, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeypair(t, pub, elligator)
+	samePub, samePriv, _, err := GenerateKeysFromPassword([]byte("password"), salt, params)
+	if err != nil || samePub != pub || samePriv != priv {
+		t.Fatal("the same password gave another keypair", err)
+	}
+
+	for name, derive := range map[string]func() ([32]byte, [32]byte, [32]byte, error){
+		"password": func() ([32]byte, [32]byte, [32]byte, error) {
+			return GenerateKeysFromPassword([]byte("other password"), salt, params)
+		},
+		"salt": func() ([32]byte, [32]byte, [32]byte, error) {
+			return GenerateKeysFromPassword([]byte("password"), []byte("another salt"), params)
+		},
+		"params": func() ([32]byte, [32]byte, [32]byte, error) {
+			return GenerateKeysFromPassword([]byte("password"), salt, Argon2Params{Time: 2, Memory: 64, Threads: 1})
+		},
+	} {
+		if otherPub, _, _, err := derive(); err != nil || otherPub == pub {
+			t.Fatal("another", name, "gave the same keypair", err)
+		}
+	}
+
+	for _, params := range []Argon2Params{{Memory: 64, Threads: 1}, {Time: 1, Threads: 1}, {Time: 1, Memory: 64}} {
+		if _, _, _, err = GenerateKeysFromPassword([]byte("password"), salt, params); !errors.Is(err, ErrInvalidParams) {
+			t.Fatal(params, err)
+		}
+	}
+}
+
+// Reads the same bytes over and over
+type stuckReader [32]byte
+
+func (r *stuckReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = r[i%len(r)]
+	}
+	return len(b), nil
+}
+
+func TestGenerateKeysContext(t *testing.T) {
+	pub, _, elligator, err := GenerateKeysContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeypair(t, pub, elligator)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err = GenerateKeysContext(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// About half of all private keys have no representative
+	var stuck stuckReader
+	for extra25519.ScalarBaseMult(&pub, &elligator, (*[32]byte)(&stuck)) {
+		stuck[0]++
+	}
+	if _, priv, _, err := GenerateKeysWithRand(&stuck); err != ErrKeygenExhausted || priv != [32]byte{} {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyStrings(t *testing.T) {
+	pub, priv, _, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		key    *[32]byte
+		encode func(*[32]byte) string
+		parse  func(string) (*[32]byte, error)
+	}{
+		{"PublicKey", &pub, EncodePublicKey, ParsePublicKey},
+		{"PublicKeyHex", &pub, EncodePublicKeyHex, ParsePublicKeyHex},
+		{"PrivateKey", &priv, EncodePrivateKey, ParsePrivateKey},
+		{"PrivateKeyHex", &priv, EncodePrivateKeyHex, ParsePrivateKeyHex},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.encode(tc.key)
+			if parsed, err := tc.parse(s); err != nil || *parsed != *tc.key {
+				t.Fatal(s, err)
+			}
+			for name, malformed := range map[string]string{
+				"empty":   "",
+				"short":   s[:len(s)-2],
+				"long":    s + s[:2],
+				"garbage": "!" + s[1:],
+				"padded":  s + "=",
+				"space":   s[:10] + " " + s[11:],
+			} {
+				if key, err := tc.parse(malformed); !errors.Is(err, ErrInvalidKey) || key != nil {
+					t.Fatal(name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	var zero [32]byte
+	// The first 16 bytes of SHA-256 over 32 zero bytes
+	if f := Fingerprint(&zero); f != "6668:7aad:f862:bd77:6c8f:c18b:8e9f:8e20" {
+		t.Fatal(f)
+	}
+	pub, _, _, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(&pub) == Fingerprint(&zero) {
+		t.Fatal("two keys share a fingerprint")
+	}
+}
+
+func TestEqualKeys(t *testing.T) {
+	pub, _, _, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := pub
+	last := pub
+	last[31] ^= 1
+	for _, tc := range []struct {
+		name  string
+		a, b  *[32]byte
+		equal bool
+	}{
+		{"Same", &pub, &same, true},
+		{"LastByte", &pub, &last, false},
+		{"BothNil", nil, nil, true},
+		{"FirstNil", nil, &pub, false},
+		{"SecondNil", &pub, nil, false},
+	} {
+		if EqualKeys(tc.a, tc.b) != tc.equal {
+			t.Fatal(tc.name)
+		}
+	}
+}
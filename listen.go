@@ -0,0 +1,99 @@
+package securenet
+
+import (
+	"fmt"
+	"net"
+)
+
+// Addr is that of the wrapped listener
+type Listener interface {
+	net.Listener
+	AcceptConn() (Conn, error)
+	GetPublicKey() *[32]byte
+}
+
+type listener struct {
+	net.Listener
+	pub       [32]byte
+	priv      [32]byte
+	elligator [32]byte
+	config    *Config
+}
+
+// This generates a keypair shared by all connections accepted on the listener
+func Listen(network, address string) (l Listener, err error) {
+	return ListenWithConfig(network, address, nil)
+}
+
+// A nil config uses the defaults
+func ListenWithConfig(network, address string, config *Config) (l Listener, err error) {
+	pub, priv, elligator, err := config.keys()
+	if err != nil {
+		return
+	}
+	inner, err := net.Listen(network, address)
+	if err != nil {
+		return
+	}
+	l = &listener{
+		Listener:  inner,
+		pub:       pub,
+		priv:      priv,
+		elligator: elligator,
+		config:    config,
+	}
+	return
+}
+
+// This wraps every connection accepted on inner with the server side of the
+// handshake. It fails with ErrInvalidKey unless elligator is the representative
+// of priv's public key
+func NewListener(inner net.Listener, priv, elligator [32]byte) (l Listener, err error) {
+	return NewListenerWithConfig(inner, priv, elligator, nil)
+}
+
+// A nil config uses the defaults, its keypair is replaced by priv and elligator
+func NewListenerWithConfig(inner net.Listener, priv, elligator [32]byte, config *Config) (l Listener, err error) {
+	keyed := Config{}
+	if config != nil {
+		keyed = *config
+	}
+	keyed.PrivateKey, keyed.Representative = &priv, &elligator
+	pub, priv, elligator, err := keyed.keys()
+	if err != nil {
+		return nil, fmt.Errorf("%w: the representative does not belong to the private key", ErrInvalidKey)
+	}
+	l = &listener{
+		Listener:  inner,
+		pub:       pub,
+		priv:      priv,
+		elligator: elligator,
+		config:    config,
+	}
+	return
+}
+
+func (l *listener) GetPublicKey() *[32]byte {
+	pub := l.pub
+	return &pub
+}
+
+// This returns as soon as the underlying listener accepted a connection, so a
+// client that never sends its hello holds up nobody else. The handshake runs on
+// the first read or write, or on Handshake, in the caller's goroutine, and its
+// error is returned from that call. The client's key is nil until then, and
+// Config.VerifyPeer has not run yet
+func (l *listener) AcceptConn() (c Conn, err error) {
+	oc, err := l.Listener.Accept()
+	if err != nil {
+		return
+	}
+	accepted := newConn(oc, l.pub, l.priv, l.elligator, true, l.config)
+	accepted.lazy = true
+	return accepted, nil
+}
+
+// The returned net.Conn is a Conn
+func (l *listener) Accept() (net.Conn, error) {
+	return l.AcceptConn()
+}
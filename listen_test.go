@@ -0,0 +1,235 @@
+package securenet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testListener(t *testing.T, config *Config) Listener {
+	t.Helper()
+	l, err := ListenWithConfig("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestAcceptSilentClient(t *testing.T) {
+	l := testListener(t, nil)
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	stalled, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	dialed := make(chan error, 1)
+	go func() {
+		c, err := Dial("tcp", l.Addr().String())
+		if err == nil {
+			err = c.WriteMessage([]byte("hello"))
+			defer c.Close()
+		}
+		dialed <- err
+	}()
+	accepted := make(chan Conn, 1)
+	go func() {
+		c, _ := l.AcceptConn()
+		accepted <- c
+	}()
+	select {
+	case c := <-accepted:
+		defer c.Close()
+		m, err := c.ReadMessage()
+		if err != nil || string(m) != "hello" {
+			t.Fatal(m, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a silent client blocked Accept")
+	}
+	if err := <-dialed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcceptReportsHandshakeError(t *testing.T) {
+	l := testListener(t, nil)
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	// Version 0 is supported by nobody
+	raw.Write(make([]byte, helloSize))
+	c, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Read(make([]byte, 1))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatal(err)
+	}
+	if err = c.Handshake(context.Background()); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatal("later calls return another error:", err)
+	}
+}
+
+func TestAcceptedHandshake(t *testing.T) {
+	l := testListener(t, nil)
+	go func() {
+		c, err := Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.WriteMessage([]byte("hi"))
+			c.Close()
+		}
+	}()
+	c, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.GetPublicKey() != nil {
+		t.Fatal("client key known before the handshake")
+	}
+	m, err := c.ReadMessage()
+	if err != nil || string(m) != "hi" {
+		t.Fatal(m, err)
+	}
+	if c.GetPublicKey() == nil || *c.GetServerPublicKey() != *l.GetPublicKey() {
+		t.Fatal("keys not set by the handshake")
+	}
+}
+
+func TestNewListenerKeys(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	pub, priv, elligator, _ := GenerateKeys()
+	_, _, otherElligator, _ := GenerateKeys()
+	if _, err := NewListener(inner, priv, otherElligator); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal(err)
+	}
+
+	l, err := NewListener(inner, priv, elligator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *l.GetPublicKey() != pub {
+		t.Fatal("listener derived another public key")
+	}
+	go func() {
+		c, err := DialWithServerKey("tcp", inner.Addr().String(), pub)
+		if err == nil {
+			c.WriteMessage([]byte("pinned"))
+			c.Close()
+		}
+	}()
+	c, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if m, err := c.ReadMessage(); err != nil || string(m) != "pinned" {
+		t.Fatal(m, err)
+	}
+}
+
+// Accepting succeeds, the first read runs the handshake and returns the error
+func TestListenerVerifyPeer(t *testing.T) {
+	rejected := errors.New("rejected")
+	verified := make(chan ConnectionState, 1)
+	l := testListener(t, &Config{VerifyPeer: func(state ConnectionState) error {
+		verified <- state
+		return rejected
+	}})
+	go func() {
+		c, err := Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.WriteMessage([]byte("unverified"))
+			c.ReadMessage()
+			c.Close()
+		}
+	}()
+	c, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case <-verified:
+		t.Fatal("verified before the handshake")
+	default:
+	}
+	if _, err = c.ReadMessage(); err != rejected {
+		t.Fatal(err)
+	}
+	if state := <-verified; !state.HandshakeComplete || state.PeerPublicKey != *c.GetPublicKey() {
+		t.Fatal(state)
+	}
+}
+
+func TestDialVerifyPeer(t *testing.T) {
+	l := testListener(t, nil)
+	go func() {
+		c, err := l.AcceptConn()
+		if err == nil {
+			c.ReadMessage()
+			c.Close()
+		}
+	}()
+	rejected := errors.New("rejected")
+	d := &Dialer{Config: &Config{VerifyPeer: func(state ConnectionState) error {
+		if state.PeerPublicKey != *l.GetPublicKey() {
+			return errors.New("wrong key verified")
+		}
+		return rejected
+	}}}
+	if _, err := d.Dial("tcp", l.Addr().String()); err != rejected {
+		t.Fatal(err)
+	}
+}
+
+// Accept serves as net.Listener's, and fails once the listener is closed
+func TestListenerAccept(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := DialWithServerKey("tcp", l.Addr().String(), *l.GetPublicKey())
+		if err == nil {
+			c.WriteMessage([]byte("accepted"))
+			c.ReadMessage()
+			c.Close()
+		}
+	}()
+	var inner net.Listener = l
+	accepted, err := inner.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := accepted.(Conn)
+	if !ok {
+		t.Fatalf("accepted a %T", accepted)
+	}
+	if m, err := c.ReadMessage(); err != nil || string(m) != "accepted" {
+		t.Fatal(string(m), err)
+	}
+	c.Close()
+
+	l.Close()
+	if _, err = l.Accept(); err == nil {
+		t.Fatal("accepted on a closed listener")
+	}
+}
@@ -0,0 +1,427 @@
+package securenet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	muxOpen byte = iota
+	muxData
+	muxWindow
+	muxClose
+)
+
+// Every mux frame is one message, starting with the frame type and the stream ID
+const muxHeaderSize = 1 + 4
+
+// Each stream may have this many unread bytes in flight
+const muxWindowSize = 256 << 10
+
+// Data frames carry at most this much payload, so streams take turns on the
+// connection, or less when the Conn's MaxFrameSize is smaller
+const muxChunkSize = 16 << 10
+
+// Pending streams beyond this are refused by closing them, without waiting for
+// the close to be sent
+const muxAcceptBacklog = 64
+
+// A Session runs independent streams over one Conn. Streams opened by the
+// client have odd IDs and streams opened by the server even ones.
+// The session reads from the Conn in its own goroutine, so it must not be read from otherwise
+type Session interface {
+	OpenStream() (Stream, error)
+	AcceptStream() (Stream, error)
+	Close() error
+}
+
+type session struct {
+	conn Conn
+
+	lock    sync.Mutex
+	streams map[uint32]*stream
+	nextID  uint32
+	accept  chan *stream
+	err     error
+	dead    chan struct{}
+}
+
+// The side that wrapped the Conn with Client or WrapClient
+func NewClientSession(c Conn) Session {
+	return newSession(c, 1)
+}
+
+// The side that wrapped the Conn with Server or WrapServer
+func NewServerSession(c Conn) Session {
+	return newSession(c, 2)
+}
+
+func newSession(c Conn, firstID uint32) *session {
+	s := &session{
+		conn:    c,
+		streams: make(map[uint32]*stream),
+		nextID:  firstID,
+		accept:  make(chan *stream, muxAcceptBacklog),
+		dead:    make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+func (s *session) OpenStream() (st Stream, err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		err = s.err
+		s.lock.Unlock()
+		return
+	}
+	id := s.nextID
+	s.nextID += 2
+	opened := newStream(s, id)
+	s.streams[id] = opened
+	s.lock.Unlock()
+
+	err = s.writeFrame(muxOpen, id, nil)
+	if err != nil {
+		s.remove(id)
+		return
+	}
+	st = opened
+	return
+}
+
+// This blocks until the peer opens a stream or the session dies
+func (s *session) AcceptStream() (st Stream, err error) {
+	select {
+	case st = <-s.accept:
+	case <-s.dead:
+		err = s.err
+	}
+	return
+}
+
+// Closing the session closes the Conn and fails all of its streams
+func (s *session) Close() error {
+	s.die(ErrClosed)
+	return s.conn.Close()
+}
+
+func (s *session) die(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.dead)
+}
+
+func (s *session) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.LittleEndian.PutUint32(frame[1:], id)
+	return s.conn.WriteMessage(append(frame, payload...))
+}
+
+func (s *session) chunkSize() int {
+	chunk := muxChunkSize
+	if max := int(s.conn.ConnectionState().MaxFrameSize) - muxHeaderSize; max < chunk {
+		chunk = max
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+	return chunk
+}
+
+func (s *session) recvLoop() {
+	for {
+		frame, err := s.conn.ReadMessage()
+		if err == nil {
+			err = s.handleFrame(frame)
+		}
+		if err != nil {
+			s.die(err)
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+func (s *session) handleFrame(frame []byte) (err error) {
+	if len(frame) < muxHeaderSize {
+		return fmt.Errorf("%w: mux frame of %d bytes", ErrMalformedFrame, len(frame))
+	}
+	frameType, id, payload := frame[0], binary.LittleEndian.Uint32(frame[1:]), frame[muxHeaderSize:]
+
+	s.lock.Lock()
+	st := s.streams[id]
+	if frameType == muxOpen {
+		if st != nil || id%2 == s.nextID%2 {
+			s.lock.Unlock()
+			return fmt.Errorf("%w: peer opened stream %d", ErrMalformedFrame, id)
+		}
+		st = newStream(s, id)
+		s.streams[id] = st
+	}
+	s.lock.Unlock()
+
+	switch frameType {
+	case muxOpen:
+		select {
+		case s.accept <- st:
+		default:
+			// This goroutine is the only reader, a blocking write here could stall it
+			go st.Close()
+		}
+	case muxData:
+		if st != nil {
+			err = st.receive(payload)
+		}
+	case muxWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("%w: window update of %d bytes", ErrMalformedFrame, len(payload))
+		}
+		if st != nil {
+			st.grow(binary.LittleEndian.Uint32(payload))
+		}
+	case muxClose:
+		if st != nil {
+			s.remove(id)
+			st.remoteClose()
+		}
+	default:
+		err = fmt.Errorf("%w: unknown mux frame type %d", ErrMalformedFrame, frameType)
+	}
+	return
+}
+
+func (s *session) remove(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+}
+
+// A Stream is one logical connection within a Session, closing it only closes the stream.
+// Its addresses are StreamAddrs
+type Stream interface {
+	net.Conn
+	ID() uint32
+}
+
+type stream struct {
+	session *session
+	id      uint32
+
+	lock          sync.Mutex
+	buf           []byte
+	unacked       uint32
+	sendWindow    uint32
+	localClosed   bool
+	remoteClosed  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// Signalled whenever buf, sendWindow, the closed flags or a deadline change
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newStream(s *session, id uint32) *stream {
+	return &stream{
+		session:    s,
+		id:         id,
+		sendWindow: muxWindowSize,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *stream) ID() uint32 {
+	return st.id
+}
+
+// Consumed bytes are returned to the peer's send window once half of it was read
+func (st *stream) Read(b []byte) (n int, err error) {
+	for {
+		st.lock.Lock()
+		if len(st.buf) > 0 {
+			n = copy(b, st.buf)
+			st.buf = st.buf[n:]
+			st.unacked += uint32(n)
+			var increment uint32
+			if st.unacked >= muxWindowSize/2 && !st.remoteClosed {
+				increment, st.unacked = st.unacked, 0
+			}
+			st.lock.Unlock()
+			if increment > 0 {
+				var update [4]byte
+				binary.LittleEndian.PutUint32(update[:], increment)
+				st.session.writeFrame(muxWindow, st.id, update[:])
+			}
+			return
+		}
+		closed, remoteClosed, deadline := st.localClosed, st.remoteClosed, st.readDeadline
+		st.lock.Unlock()
+		if closed {
+			return 0, ErrClosed
+		}
+		if remoteClosed {
+			return 0, io.EOF
+		}
+		err = st.wait(st.readable, deadline)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Writes block while the peer's receive window is exhausted
+func (st *stream) Write(b []byte) (n int, err error) {
+	max := st.session.chunkSize()
+	for len(b) > 0 {
+		st.lock.Lock()
+		closed, window, deadline := st.localClosed || st.remoteClosed, st.sendWindow, st.writeDeadline
+		chunk := len(b)
+		if chunk > max {
+			chunk = max
+		}
+		if uint32(chunk) > window {
+			chunk = int(window)
+		}
+		st.sendWindow -= uint32(chunk)
+		st.lock.Unlock()
+		if closed {
+			return n, ErrClosed
+		}
+		if chunk == 0 {
+			err = st.wait(st.writable, deadline)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		err = st.session.writeFrame(muxData, st.id, b[:chunk])
+		if err != nil {
+			// The peer never saw the chunk, so it still counts toward the window
+			st.lock.Lock()
+			st.sendWindow += uint32(chunk)
+			st.lock.Unlock()
+			return
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return
+}
+
+func (st *stream) wait(ch chan struct{}, deadline time.Time) (err error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-timeout:
+		err = &timeoutError{"stream deadline exceeded"}
+	case <-st.session.dead:
+		err = st.session.err
+	}
+	return
+}
+
+// The peer reads io.EOF once it consumed everything sent before the close
+func (st *stream) Close() (err error) {
+	st.lock.Lock()
+	if st.localClosed {
+		st.lock.Unlock()
+		return
+	}
+	st.localClosed = true
+	st.lock.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	st.session.remove(st.id)
+	return st.session.writeFrame(muxClose, st.id, nil)
+}
+
+func (st *stream) receive(b []byte) (err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if uint64(len(st.buf))+uint64(st.unacked)+uint64(len(b)) > muxWindowSize {
+		return fmt.Errorf("%w: stream %d exceeded its receive window", ErrMalformedFrame, st.id)
+	}
+	if st.localClosed {
+		return
+	}
+	st.buf = append(st.buf, b...)
+	notify(st.readable)
+	return
+}
+
+func (st *stream) grow(increment uint32) {
+	st.lock.Lock()
+	st.sendWindow += increment
+	st.lock.Unlock()
+	notify(st.writable)
+}
+
+func (st *stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	st.lock.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// The address of a stream is that of its session's Conn together with the stream ID,
+// both ends of a stream see the same ID
+type StreamAddr struct {
+	net.Addr
+	ID uint32
+}
+
+func (a *StreamAddr) String() string {
+	return fmt.Sprintf("%s/%d", a.Addr, a.ID)
+}
+
+func (st *stream) LocalAddr() net.Addr {
+	return &StreamAddr{st.session.conn.LocalAddr(), st.id}
+}
+
+func (st *stream) RemoteAddr() net.Addr {
+	return &StreamAddr{st.session.conn.RemoteAddr(), st.id}
+}
+
+func (st *stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+	notify(st.writable)
+	return nil
+}
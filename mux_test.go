@@ -0,0 +1,198 @@
+package securenet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func sessionPair(t *testing.T, clientConfig, serverConfig *Config) (clientSession, serverSession Session) {
+	t.Helper()
+	client, server := testConns(t, clientConfig, serverConfig)
+	clientSession, serverSession = NewClientSession(client), NewServerSession(server)
+	t.Cleanup(func() {
+		clientSession.Close()
+		serverSession.Close()
+	})
+	return
+}
+
+func streamPair(t *testing.T, clientSession, serverSession Session) (opened, accepted Stream) {
+	t.Helper()
+	opened, err := clientSession.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err = serverSession.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Stream addresses are those of the Conn with the stream ID, the same on both ends
+func TestStreamAddr(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	clientSession, serverSession := NewClientSession(client), NewServerSession(server)
+	defer clientSession.Close()
+	defer serverSession.Close()
+	for i := 0; i < 2; i++ {
+		opened, err := clientSession.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := serverSession.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			addr, want net.Addr
+		}{
+			{opened.LocalAddr(), client.LocalAddr()},
+			{opened.RemoteAddr(), client.RemoteAddr()},
+			{accepted.LocalAddr(), server.LocalAddr()},
+			{accepted.RemoteAddr(), server.RemoteAddr()},
+		} {
+			addr, ok := tc.addr.(*StreamAddr)
+			if !ok || addr.Addr != tc.want || addr.ID != uint32(2*i+1) {
+				t.Fatalf("%T %v", tc.addr, tc.addr)
+			}
+			if addr.Network() != "tcp" || addr.String() != fmt.Sprintf("%s/%d", tc.want, 2*i+1) {
+				t.Fatal(addr.Network(), addr.String())
+			}
+		}
+	}
+}
+
+func TestStreamBothWays(t *testing.T) {
+	clientSession, serverSession := sessionPair(t, nil, nil)
+	opened, accepted := streamPair(t, clientSession, serverSession)
+	for _, tc := range []struct {
+		from, to Stream
+	}{
+		{opened, accepted},
+		{accepted, opened},
+	} {
+		want := randomBytes(t, 3*muxChunkSize+1)
+		go tc.from.Write(want)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(tc.to, got); err != nil || !bytes.Equal(got, want) {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A writer stops once the window is used up and goes on once the reader returned it
+func TestStreamWindow(t *testing.T) {
+	clientSession, serverSession := sessionPair(t, nil, nil)
+	opened, accepted := streamPair(t, clientSession, serverSession)
+	want := randomBytes(t, muxWindowSize+1000)
+	opened.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := opened.Write(want)
+	if !isTimeout(err) || n != muxWindowSize {
+		t.Fatal(n, err)
+	}
+	opened.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := opened.Write(want[n:])
+		done <- err
+	}()
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(accepted, got); err != nil || !bytes.Equal(got, want) {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The peer's close arrives after its data and drops the stream from the session
+func TestStreamEOF(t *testing.T) {
+	clientSession, serverSession := sessionPair(t, nil, nil)
+	opened, accepted := streamPair(t, clientSession, serverSession)
+	go func() {
+		opened.Write([]byte("bye"))
+		opened.Close()
+	}()
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(accepted)
+	if err != nil || string(got) != "bye" {
+		t.Fatal(string(got), err)
+	}
+	if _, err = accepted.Write([]byte("late")); err != ErrClosed {
+		t.Fatal(err)
+	}
+	s := serverSession.(*session)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.streams) != 0 {
+		t.Fatal(len(s.streams), "streams left")
+	}
+}
+
+// Streams beyond the backlog are closed without blocking the session
+func TestStreamBacklog(t *testing.T) {
+	clientSession, serverSession := sessionPair(t, nil, nil)
+	var streams []Stream
+	for i := 0; i <= muxAcceptBacklog; i++ {
+		st, err := clientSession.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, st)
+	}
+	refused := streams[muxAcceptBacklog]
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal(err)
+	}
+	accepted, err := serverSession.AcceptStream()
+	if err != nil || accepted.ID() != streams[0].ID() {
+		t.Fatal(accepted, err)
+	}
+	go streams[0].Write([]byte("still here"))
+	got := make([]byte, len("still here"))
+	if _, err = io.ReadFull(accepted, got); err != nil || string(got) != "still here" {
+		t.Fatal(string(got), err)
+	}
+}
+
+// Data frames shrink to fit a MaxFrameSize below muxChunkSize
+func TestStreamSmallFrames(t *testing.T) {
+	clientSession, serverSession := sessionPair(t, nil, &Config{MaxFrameSize: 4096})
+	opened, accepted := streamPair(t, clientSession, serverSession)
+	want := randomBytes(t, 5*muxChunkSize)
+	done := make(chan error, 1)
+	go func() {
+		_, err := opened.Write(want)
+		done <- err
+	}()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(accepted, got); err != nil || !bytes.Equal(got, want) {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A chunk that never went out is given back to the window
+func TestStreamFailedWrite(t *testing.T) {
+	clientSession, serverSession := sessionPair(t, nil, nil)
+	opened, _ := streamPair(t, clientSession, serverSession)
+	clientSession.(*session).conn.Close()
+	if _, err := opened.Write([]byte("lost")); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+	st := opened.(*stream)
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.sendWindow != muxWindowSize {
+		t.Fatal(st.sendWindow)
+	}
+}
@@ -0,0 +1,482 @@
+package securenet
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Exactly 32 bytes, so it is the initial handshake hash as is
+const noiseProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+// No message of the pattern comes close, anything longer is refused unread
+const maxNoiseMessageSize = 1024
+
+// Transport messages are at most 65535 bytes, tag included
+const maxNoisePayloadSize = 1<<16 - 1 - box.Overhead
+
+// The SymmetricState of the Noise specification
+type noiseState struct {
+	ck, h [32]byte
+	k     *[32]byte
+	n     uint64
+}
+
+func newNoiseState(prologue []byte) *noiseState {
+	s := &noiseState{}
+	copy(s.h[:], noiseProtocolName)
+	s.ck = s.h
+	s.mixHash(prologue)
+	return s
+}
+
+func (s *noiseState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(s.h[:])
+	hash.Write(data)
+	hash.Sum(s.h[:0])
+}
+
+// HKDF with the chaining key as salt, returning two outputs
+func (s *noiseState) hkdf(ikm []byte) (out1, out2 [32]byte) {
+	mac := hmac.New(sha256.New, s.ck[:])
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	defer wipe(temp)
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	mac.Sum(out1[:0])
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1[:])
+	mac.Write([]byte{2})
+	mac.Sum(out2[:0])
+	return
+}
+
+func (s *noiseState) mixKey(ikm []byte) {
+	ck, k := s.hkdf(ikm)
+	wipe(s.ck[:])
+	s.ck = ck
+	if s.k != nil {
+		wipe(s.k[:])
+	}
+	s.k, s.n = &k, 0
+}
+
+func (s *noiseState) nonce() []byte {
+	nonce := noiseNonce(s.n)
+	s.n++
+	return nonce
+}
+
+// Nonces are 4 zero bytes followed by the little endian counter
+func noiseNonce(n uint64) []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce[:]
+}
+
+func (s *noiseState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
+	ciphertext = plaintext
+	if s.k != nil {
+		aead, err := chacha20poly1305.New(s.k[:])
+		if err != nil {
+			return nil, err
+		}
+		ciphertext = aead.Seal(nil, s.nonce(), plaintext, s.h[:])
+	}
+	s.mixHash(ciphertext)
+	return
+}
+
+func (s *noiseState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+	plaintext = ciphertext
+	if s.k != nil {
+		aead, err := chacha20poly1305.New(s.k[:])
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err = aead.Open(nil, s.nonce(), ciphertext, s.h[:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: noise message does not open", ErrHandshake)
+		}
+	}
+	s.mixHash(ciphertext)
+	return
+}
+
+// The DH of the Noise specification, low order points are refused
+func (s *noiseState) mixDH(priv, pub *[32]byte) (err error) {
+	dh, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		return ErrInvalidPeerKey
+	}
+	defer wipe(dh)
+	s.mixKey(dh)
+	return
+}
+
+func (s *noiseState) wipe() {
+	wipe(s.ck[:])
+	if s.k != nil {
+		wipe(s.k[:])
+	}
+}
+
+// Noise_XX_25519_ChaChaPoly_SHA256 with the static keys and the PSK as the
+// prologue, each message prefixed by its length as 2 big endian bytes:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// The payloads carry what the hellos would. The client's first is its highest
+// version, the server's is its highest version followed by its MaxFrameSize
+// from version 6 on, and the client's last is its MaxFrameSize from version 6
+// on. Both keys of Split seal the transport, the first one is also the DH
+// output and the handshake hash the transcript, bound to the session key as usual
+func (h *handshake) noise() (peerKey, shared [32]byte, err error) {
+	s := newNoiseState(h.config.psk())
+	defer s.wipe()
+	ePub, ePriv, err := box.GenerateKey(h.config.rand())
+	if err != nil {
+		return
+	}
+	defer wipe(ePriv[:])
+
+	var peerEphemeral [32]byte
+	if h.server {
+		var payload []byte
+		payload, err = h.readNoise(s, &peerEphemeral, nil)
+		if err != nil {
+			return
+		}
+		err = h.noiseVersion(payload)
+		if err != nil {
+			return
+		}
+
+		payload = []byte{h.config.maxVersion()}
+		if h.version >= Version6 {
+			payload = appendFrameSize(payload, h.config)
+		}
+		err = h.writeNoise(s, ePub, func(msg []byte) ([]byte, error) {
+			err := s.mixDH(ePriv, &peerEphemeral)
+			if err != nil {
+				return nil, err
+			}
+			sealed, err := s.encryptAndHash(h.pub[:])
+			if err != nil {
+				return nil, err
+			}
+			err = s.mixDH(h.priv, &peerEphemeral)
+			if err != nil {
+				return nil, err
+			}
+			return append(msg, sealed...), nil
+		}, payload)
+		if err != nil {
+			return
+		}
+
+		payload, err = h.readNoise(s, nil, func(msg []byte) ([]byte, error) {
+			if len(msg) < 32+box.Overhead {
+				return nil, fmt.Errorf("%w: noise message of %d bytes", ErrHandshake, len(msg))
+			}
+			opened, err := s.decryptAndHash(msg[:32+box.Overhead])
+			if err != nil {
+				return nil, err
+			}
+			copy(peerKey[:], opened)
+			err = s.mixDH(ePriv, &peerKey)
+			return msg[32+box.Overhead:], err
+		})
+		if err != nil {
+			return
+		}
+		if EqualKeys(&peerKey, h.pub) {
+			err = ErrReflectedKey
+			return
+		}
+		err = h.authorizeClient(&peerKey)
+		if err != nil {
+			return
+		}
+		if h.version >= Version6 {
+			err = h.noiseFrameSize(payload)
+		}
+	} else {
+		err = h.writeNoise(s, ePub, nil, []byte{h.config.maxVersion()})
+		if err != nil {
+			return
+		}
+
+		var payload []byte
+		payload, err = h.readNoise(s, &peerEphemeral, func(msg []byte) ([]byte, error) {
+			err := s.mixDH(ePriv, &peerEphemeral)
+			if err != nil {
+				return nil, err
+			}
+			if len(msg) < 32+box.Overhead {
+				return nil, fmt.Errorf("%w: noise message of %d bytes", ErrHandshake, len(msg))
+			}
+			opened, err := s.decryptAndHash(msg[:32+box.Overhead])
+			if err != nil {
+				return nil, err
+			}
+			copy(peerKey[:], opened)
+			err = s.mixDH(ePriv, &peerKey)
+			return msg[32+box.Overhead:], err
+		})
+		if err != nil {
+			return
+		}
+		if EqualKeys(&peerKey, h.pub) {
+			err = ErrReflectedKey
+			return
+		}
+		err = h.verifyServer(&peerKey)
+		if err != nil {
+			return
+		}
+		err = h.noiseServerPayload(payload)
+		if err != nil {
+			return
+		}
+
+		var payload3 []byte
+		if h.version >= Version6 {
+			payload3 = appendFrameSize(nil, h.config)
+		}
+		err = h.writeNoise(s, nil, func(msg []byte) ([]byte, error) {
+			sealed, err := s.encryptAndHash(h.pub[:])
+			if err != nil {
+				return nil, err
+			}
+			err = s.mixDH(h.priv, &peerEphemeral)
+			return append(msg, sealed...), err
+		}, payload3)
+		if err != nil {
+			return
+		}
+	}
+
+	k1, k2 := s.hkdf(nil)
+	shared = k1
+	if h.server {
+		h.noiseSend, h.noiseRecv = &k2, &k1
+	} else {
+		h.noiseSend, h.noiseRecv = &k1, &k2
+	}
+	h.transcript = append(h.transcript, s.h[:]...)
+	return
+}
+
+// The ephemeral key, if any, goes first, then whatever tokens adds, then the
+// payload encrypted under the current key
+func (h *handshake) writeNoise(s *noiseState, e *[32]byte, tokens func([]byte) ([]byte, error), payload []byte) (err error) {
+	msg := make([]byte, 2, 2+96)
+	if e != nil {
+		s.mixHash(e[:])
+		msg = append(msg, e[:]...)
+	}
+	if tokens != nil {
+		msg, err = tokens(msg)
+		if err != nil {
+			return
+		}
+	}
+	sealed, err := s.encryptAndHash(payload)
+	if err != nil {
+		return
+	}
+	msg = append(msg, sealed...)
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+	return writeFull(h.oc, msg)
+}
+
+// The counterpart of writeNoise, tokens consumes its part of the message and
+// returns the rest, which holds the payload
+func (h *handshake) readNoise(s *noiseState, e *[32]byte, tokens func([]byte) ([]byte, error)) (payload []byte, err error) {
+	var length [2]byte
+	_, err = io.ReadFull(h.bRead, length[:])
+	if err != nil {
+		return
+	}
+	size := binary.BigEndian.Uint16(length[:])
+	if size > maxNoiseMessageSize {
+		err = fmt.Errorf("%w: noise message of %d bytes", ErrHandshake, size)
+		return
+	}
+	msg := make([]byte, size)
+	_, err = io.ReadFull(h.bRead, msg)
+	if err != nil {
+		return
+	}
+	if e != nil {
+		if len(msg) < 32 {
+			err = fmt.Errorf("%w: noise message of %d bytes", ErrHandshake, size)
+			return
+		}
+		copy(e[:], msg)
+		s.mixHash(msg[:32])
+		msg = msg[32:]
+	}
+	if tokens != nil {
+		msg, err = tokens(msg)
+		if err != nil {
+			return
+		}
+	}
+	return s.decryptAndHash(msg)
+}
+
+// Both sides settle on the lower of their highest versions, as in readHello
+func (h *handshake) noiseVersion(payload []byte) (err error) {
+	if len(payload) != 1 {
+		return fmt.Errorf("%w: noise payload of %d bytes", ErrHandshake, len(payload))
+	}
+	h.version = payload[0]
+	if local := h.config.maxVersion(); h.version > local {
+		h.version = local
+	}
+	if h.version < minVersion {
+		return fmt.Errorf("%w: peer supports up to version %d", ErrUnsupportedVersion, payload[0])
+	}
+	h.aead = noiseCipher{}
+	return
+}
+
+func (h *handshake) noiseServerPayload(payload []byte) (err error) {
+	if len(payload) < 1 {
+		return fmt.Errorf("%w: empty noise payload", ErrHandshake)
+	}
+	err = h.noiseVersion(payload[:1])
+	if err != nil || h.version < Version6 {
+		return
+	}
+	return h.noiseFrameSize(payload[1:])
+}
+
+func (h *handshake) noiseFrameSize(payload []byte) (err error) {
+	if len(payload) != 4 {
+		return fmt.Errorf("%w: noise payload of %d bytes", ErrHandshake, len(payload))
+	}
+	h.peerMaxFrameSize = binary.LittleEndian.Uint32(payload)
+	if h.peerMaxFrameSize == 0 {
+		err = fmt.Errorf("%w: peer accepts no frames", ErrHandshake)
+	}
+	return
+}
+
+// ChaCha20-Poly1305 with 12 byte nonces, the cipher of the Noise transport. It
+// is never named in a hello, so its ID is zero
+type noiseCipher struct{}
+
+func (noiseCipher) ID() byte {
+	return 0
+}
+
+func (noiseCipher) New(key *[32]byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key[:])
+}
+
+// After a Noise handshake every frame is a transport message, its length as 2
+// big endian bytes followed by the payload sealed under the key of this
+// direction with the frame's sequence number as the nonce and no additional
+// data. Only data goes over the transport, close frames are sent as the empty
+// message CloseWrite sends and every other type fails with ErrNoiseTransport
+func (c *conn) writeNoiseFrame(frameType byte, b []byte) (err error) {
+	switch frameType {
+	case frameData:
+	case frameClose:
+		b = nil
+	default:
+		return ErrNoiseTransport
+	}
+	sealer, err := c.sealer.get(c.aead, c.sendKey)
+	if err != nil {
+		return
+	}
+	pooled := getBuffer(2 + len(b) + box.Overhead)
+	defer putBuffer(pooled)
+	msg := (*pooled)[:2]
+	binary.BigEndian.PutUint16(msg, uint16(len(b)+box.Overhead))
+	msg = sealer.Seal(msg, noiseNonce(c.writeSequence), b, nil)
+	c.writeSequence++
+	atomic.StoreInt64(&c.lastSent, time.Now().UnixNano())
+	c.refreshDeadline(false)
+	err = writeFull(c.Conn, msg)
+	if err != nil {
+		return
+	}
+	atomic.AddUint64(&c.stats.FramesSent, 1)
+	c.event(Event{Type: EventFrameSent, Size: len(msg)})
+	return
+}
+
+// The counterpart of writeNoiseFrame, every message is read as a data frame
+func (c *conn) readNoiseFrame() (frameType byte, decrypted []byte, err error) {
+	frameType = frameData
+	err = c.fill(2)
+	if err != nil {
+		if len(c.partial) > 0 {
+			err = midFrame(err)
+		}
+		return
+	}
+	length := int(binary.BigEndian.Uint16(c.partial))
+	if length < box.Overhead {
+		err = fmt.Errorf("%w: noise message of %d bytes", ErrMalformedFrame, length)
+		return
+	}
+	if uint64(length) > uint64(c.maxFrameSize)+box.Overhead {
+		err = fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+		return
+	}
+	err = c.fill(2 + length)
+	if err != nil {
+		err = midFrame(err)
+		return
+	}
+
+	opener, err := c.opener.get(c.aead, c.recvKey)
+	if err != nil {
+		return
+	}
+	dst, into := c.openBuffer(length - box.Overhead)
+	decrypted, openErr := opener.Open(dst, noiseNonce(c.readSequence), c.partial[2:2+length], nil)
+	if openErr != nil {
+		err = &AuthError{Sequence: c.readSequence}
+		atomic.AddUint64(&c.stats.DecryptFailures, 1)
+		c.event(Event{Type: EventDecryptFailure, Err: err})
+		return
+	}
+	if !into {
+		c.plaintext = decrypted
+	}
+	c.partial = c.partial[:0]
+	c.readSequence++
+	atomic.AddUint64(&c.stats.FramesReceived, 1)
+	c.event(Event{Type: EventFrameReceived, Size: 2 + length})
+	return
+}
+
+// The transport replaces the direction keys establish derived, callers hold
+// readLock and writeLock
+func (c *conn) useNoiseKeys(sendKey, recvKey *[32]byte) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	wipeKey(c.sendKey)
+	wipeKey(c.recvKey)
+	c.sendKey, c.recvKey = sendKey, recvKey
+}
@@ -0,0 +1,183 @@
+package securenet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func noiseConfig(t *testing.T) *Config {
+	config := testKeys(t)
+	config.Noise = true
+	return config
+}
+
+func readNoiseMessage(t *testing.T, c net.Conn) []byte {
+	t.Helper()
+	var length [2]byte
+	if _, err := io.ReadFull(c, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func writeNoiseMessage(t *testing.T, c net.Conn, msg []byte) {
+	t.Helper()
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(msg)))
+	if err := writeFull(c, append(length[:], msg...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The responder of Noise_XX run by hand, then the transport sealed and opened
+// with the CipherStates of Split rather than by a Conn
+func TestNoiseTransport(t *testing.T) {
+	clientConfig := noiseConfig(t)
+	serverPub, serverPriv, _, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() {
+		client, err := Client(a, clientConfig)
+		if err != nil {
+			done <- err
+			return
+		}
+		if err = client.WriteMessage([]byte("to server")); err != nil {
+			done <- err
+			return
+		}
+		m, err := client.ReadMessage()
+		if err == nil && string(m) != "to client" {
+			err = errors.New("client read " + string(m))
+		}
+		done <- err
+	}()
+
+	s := newNoiseState(nil)
+	msg := readNoiseMessage(t, b)
+	var clientEphemeral [32]byte
+	copy(clientEphemeral[:], msg)
+	s.mixHash(msg[:32])
+	if payload, err := s.decryptAndHash(msg[32:]); err != nil || len(payload) != 1 || payload[0] != maxVersion {
+		t.Fatal(payload, err)
+	}
+	ePub, ePriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mixHash(ePub[:])
+	msg = append([]byte{}, ePub[:]...)
+	if err = s.mixDH(ePriv, &clientEphemeral); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := s.encryptAndHash(serverPub[:])
+	msg = append(msg, sealed...)
+	if err = s.mixDH(&serverPriv, &clientEphemeral); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ = s.encryptAndHash(appendFrameSize([]byte{maxVersion}, nil))
+	writeNoiseMessage(t, b, append(msg, sealed...))
+
+	msg = readNoiseMessage(t, b)
+	opened, err := s.decryptAndHash(msg[:32+box.Overhead])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clientPub [32]byte
+	copy(clientPub[:], opened)
+	if err = s.mixDH(ePriv, &clientPub); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.decryptAndHash(msg[32+box.Overhead:]); err != nil {
+		t.Fatal(err)
+	}
+	k1, k2 := s.hkdf(nil)
+	toServer, _ := chacha20poly1305.New(k1[:])
+	toClient, _ := chacha20poly1305.New(k2[:])
+
+	m, err := toServer.Open(nil, noiseNonce(0), readNoiseMessage(t, b), nil)
+	if err != nil || string(m) != "to server" {
+		t.Fatal(string(m), err)
+	}
+	writeNoiseMessage(t, b, toClient.Seal(nil, noiseNonce(0), []byte("to client"), nil))
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoiseConn(t *testing.T) {
+	clientConfig, serverConfig := noiseConfig(t), noiseConfig(t)
+	clientConfig.Compression, serverConfig.Compression = Flate, Flate
+	client, server := testConns(t, clientConfig, serverConfig)
+	if state := client.ConnectionState(); state.MaxFrameSize > maxNoisePayloadSize || state.AEAD != 0 {
+		t.Fatal(state.MaxFrameSize, state.AEAD)
+	}
+
+	want := randomBytes(t, 200000)
+	go func() {
+		client.Write(want)
+		client.WriteMessage(compressible)
+		client.CloseWrite()
+	}()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != string(want) {
+		t.Fatal(err)
+	}
+	if m, err := server.ReadMessage(); err != nil || string(m) != string(compressible) {
+		t.Fatal(len(m), err)
+	}
+	if _, err := server.ReadMessage(); err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if _, err := server.Ping(context.Background()); err != ErrNoiseTransport {
+		t.Fatal(err)
+	}
+	if err := server.Rekey(); err != ErrNoiseTransport {
+		t.Fatal(err)
+	}
+	if err := server.Rehandshake(context.Background()); err != ErrNoiseTransport {
+		t.Fatal(err)
+	}
+	go server.Close()
+	if _, err := client.ReadMessage(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+// The PSK is the prologue, so a mismatch fails the handshake
+func TestNoisePSK(t *testing.T) {
+	clientConfig, serverConfig := noiseConfig(t), noiseConfig(t)
+	clientConfig.PSK, serverConfig.PSK = []byte("one"), []byte("two")
+	a, b := tcpPair(t)
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Server(b, serverConfig)
+		b.Close()
+		done <- err
+	}()
+	_, err := Client(a, clientConfig)
+	a.Close()
+	if serverErr := <-done; err == nil && serverErr == nil {
+		t.Fatal("handshake succeeded with different PSKs")
+	}
+}
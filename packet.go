@@ -0,0 +1,401 @@
+package securenet
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const helloSize = 32 + 1
+
+// From version 8 on a datagram hello ends with 32 random bytes
+const packetHelloSize = helloSize + 32
+
+// A datagram is a random nonce followed by the sealed sequence number and payload
+const packetOverhead = 24 + box.Overhead + 8
+
+const maxDatagramSize = 64 << 10
+
+// The client resends its hello this often until the server answers
+const packetRetransmit = 500 * time.Millisecond
+
+// Used when Config.HandshakeTimeout is not set, lost hellos are not waited for forever
+const defaultPacketHandshakeTimeout = 10 * time.Second
+
+// Datagrams are sealed independently and may arrive reordered or not at all,
+// forged, replayed and undecryptable datagrams are silently dropped.
+// ReadFrom and WriteTo only exchange datagrams with the peer of the handshake,
+// whose address RemoteAddr returns. LocalAddr is that of the wrapped PacketConn
+type PacketConn interface {
+	net.PacketConn
+	GetPublicKey() *[32]byte
+	GetServerPublicKey() *[32]byte
+	RemoteAddr() net.Addr
+}
+
+type packetConn struct {
+	writeSequence uint64
+
+	net.PacketConn
+	peer            net.Addr
+	privateKey      *[32]byte
+	PublicKey       *[32]byte
+	ServerPublicKey *[32]byte
+	sendKey         *[32]byte
+	recvKey         *[32]byte
+	hello           []byte
+	peerHello       []byte
+	isServer        bool
+	rand            io.Reader
+
+	readLock  sync.Mutex
+	window    replayWindow
+	readBuf   []byte
+	plaintext []byte
+	// Held for reading by WriteTo, so Close never wipes a key while it seals
+	writeLock sync.RWMutex
+	closed    bool
+}
+
+// The client end of a datagram session with the server at peer.
+// The hello is resent until the server answers or the handshake times out.
+// A PacketConn can not report its read deadline, so the handshake clears any
+// deadline set on pc before, set deadlines on the returned PacketConn instead
+func WrapPacket(pc net.PacketConn, peer net.Addr, config *Config) (nc PacketConn, err error) {
+	c, err := newPacketConn(pc, false, config)
+	if err != nil {
+		return
+	}
+	c.peer = peer
+	defer pc.SetReadDeadline(time.Time{})
+	end := time.Now().Add(packetHandshakeTimeout(config))
+	for {
+		_, err = pc.WriteTo(c.hello[:], peer)
+		if err != nil {
+			return
+		}
+		retryAt := time.Now().Add(packetRetransmit)
+		if retryAt.After(end) {
+			retryAt = end
+		}
+		err = c.readServerHello(retryAt)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if time.Now().Before(end) {
+				continue
+			}
+			err = ErrHandshakeTimeout
+		}
+		if err != nil {
+			return
+		}
+		break
+	}
+
+	peerKey, version, err := parsePacketHello(c.peerHello, config)
+	if err != nil {
+		return
+	}
+	if (version >= Version8) != (len(c.peerHello) == packetHelloSize) {
+		err = fmt.Errorf("%w: hello of %d bytes for version %d", ErrHandshake, len(c.peerHello), version)
+		return
+	}
+	if EqualKeys(&peerKey, c.PublicKey) {
+		err = ErrReflectedKey
+		return
+	}
+	if config != nil && config.ServerPublicKey != nil && !EqualKeys(&peerKey, config.ServerPublicKey) {
+		err = ErrServerKeyMismatch
+		return
+	}
+	c.ServerPublicKey = &peerKey
+	c.setKeys(&peerKey, config, version, c.hello, c.peerHello)
+	nc = c
+	return
+}
+
+// The server end of a datagram session, the first client sending a valid hello becomes the peer.
+// Datagrams that are not a valid hello are ignored until then. Without
+// Config.HandshakeTimeout a read deadline set on pc bounds the handshake and is
+// kept, with it pc's read deadline is cleared once the handshake returns
+func WrapPacketServer(pc net.PacketConn, config *Config) (nc PacketConn, err error) {
+	c, err := newPacketConn(pc, true, config)
+	if err != nil {
+		return
+	}
+	if timeout := config.handshakeTimeout(); timeout > 0 {
+		err = pc.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return
+		}
+		defer pc.SetReadDeadline(time.Time{})
+	}
+
+	var peerKey [32]byte
+	var version uint8
+	for {
+		var n int
+		n, c.peer, err = pc.ReadFrom(c.readBuf)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = ErrHandshakeTimeout
+		}
+		if err != nil {
+			return
+		}
+		// Clients of version 8 or later send random bytes with their hello
+		if n != helloSize && n != packetHelloSize || (n == packetHelloSize) != (c.readBuf[32] >= Version8) {
+			continue
+		}
+		var helloErr error
+		peerKey, version, helloErr = parsePacketHello(c.readBuf[:n], config)
+		if helloErr != nil || EqualKeys(&peerKey, c.ServerPublicKey) {
+			continue
+		}
+		if config != nil && config.AuthorizeClient != nil && !config.AuthorizeClient(&peerKey) {
+			continue
+		}
+		c.peerHello = append([]byte{}, c.readBuf[:n]...)
+		break
+	}
+	if version >= Version8 {
+		c.hello, err = appendRandom(c.hello, c.rand)
+		if err != nil {
+			return
+		}
+	}
+	_, err = pc.WriteTo(c.hello, c.peer)
+	if err != nil {
+		return
+	}
+	c.PublicKey = &peerKey
+	c.setKeys(&peerKey, config, version, c.peerHello, c.hello)
+	nc = c
+	return
+}
+
+func newPacketConn(pc net.PacketConn, server bool, config *Config) (c *packetConn, err error) {
+	pub, priv, elligator, err := config.keys()
+	if err != nil {
+		return
+	}
+	c = &packetConn{
+		PacketConn: pc,
+		privateKey: &priv,
+		isServer:   server,
+		rand:       config.rand(),
+		readBuf:    make([]byte, maxDatagramSize),
+	}
+	if server {
+		c.ServerPublicKey = &pub
+	} else {
+		c.PublicKey = &pub
+	}
+	c.hello = append(elligator[:], config.maxVersion())
+	// The server only adds its random bytes once it knows the client's version
+	if !server && config.maxVersion() >= Version8 {
+		c.hello, err = appendRandom(c.hello, c.rand)
+	}
+	return
+}
+
+func appendRandom(b []byte, r io.Reader) ([]byte, error) {
+	random := make([]byte, 32)
+	_, err := io.ReadFull(r, random)
+	return append(b, random...), err
+}
+
+func parsePacketHello(b []byte, config *Config) (peerKey [32]byte, version uint8, err error) {
+	var hello [helloSize]byte
+	copy(hello[:], b)
+	return parseHello(&hello, config)
+}
+
+func packetHandshakeTimeout(config *Config) time.Duration {
+	if timeout := config.handshakeTimeout(); timeout > 0 {
+		return timeout
+	}
+	return defaultPacketHandshakeTimeout
+}
+
+// Datagrams from other addresses and data that raced ahead of the hello are skipped
+func (c *packetConn) readServerHello(deadline time.Time) (err error) {
+	err = c.PacketConn.SetReadDeadline(deadline)
+	if err != nil {
+		return
+	}
+	for {
+		n, from, err := c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return err
+		}
+		if (n == helloSize || n == packetHelloSize) && from.String() == c.peer.String() {
+			c.peerHello = append([]byte{}, c.readBuf[:n]...)
+			return nil
+		}
+	}
+}
+
+// From version 8 on each direction has its own key, so a datagram reflected back
+// to its sender fails to open, and the random bytes of both hellos keep any two
+// sessions from sharing keys. Earlier versions seal both directions under one key
+func (c *packetConn) setKeys(peerKey *[32]byte, config *Config, version uint8, clientHello, serverHello []byte) {
+	var shared [32]byte
+	box.Precompute(&shared, peerKey, c.privateKey)
+	defer wipe(shared[:])
+	transcript := append(append([]byte{}, clientHello...), serverHello...)
+	bound := bindTranscript(&shared, config.psk(), transcript)
+	if version < Version8 {
+		c.sendKey, c.recvKey = bound, copyKey(bound)
+		return
+	}
+	defer wipe(bound[:])
+	clientKey, serverKey := c.PublicKey, c.ServerPublicKey
+	clientToServer := directionKey(bound, "securenet packet client to server", clientKey, serverKey)
+	serverToClient := directionKey(bound, "securenet packet server to client", clientKey, serverKey)
+	c.sendKey, c.recvKey = clientToServer, serverToClient
+	if c.isServer {
+		c.sendKey, c.recvKey = serverToClient, clientToServer
+	}
+}
+
+// Both keys are set before the wrap functions return, the getters return copies
+func (c *packetConn) GetPublicKey() *[32]byte {
+	return copyKey(c.PublicKey)
+}
+
+func (c *packetConn) GetServerPublicKey() *[32]byte {
+	return copyKey(c.ServerPublicKey)
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// Payloads longer than b are truncated, like on a plain UDP socket.
+// A repeated client hello means the server hello was lost, so the server sends it again
+func (c *packetConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for {
+		var read int
+		var from net.Addr
+		read, from, err = c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return
+		}
+		if from.String() != c.peer.String() {
+			continue
+		}
+		datagram := c.readBuf[:read]
+		if c.isServer && subtle.ConstantTimeCompare(datagram, c.peerHello) == 1 {
+			c.PacketConn.WriteTo(c.hello, c.peer)
+			continue
+		}
+		if read < packetOverhead {
+			continue
+		}
+		var nonce [24]byte
+		copy(nonce[:], datagram)
+		opened, success := box.OpenAfterPrecomputation(c.plaintext[:0], datagram[24:], &nonce, c.recvKey)
+		if !success {
+			continue
+		}
+		c.plaintext = opened
+		if !c.window.accept(binary.LittleEndian.Uint64(opened)) {
+			continue
+		}
+		return copy(b, opened[8:]), from, nil
+	}
+}
+
+// The datagram is only sent to the peer of the handshake, a nil addr means the peer
+// and any other addr is refused
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	if addr != nil && addr.String() != c.peer.String() {
+		err = ErrUnknownPeer
+		return
+	}
+	if len(b)+packetOverhead > maxDatagramSize {
+		err = ErrFrameTooLarge
+		return
+	}
+	c.writeLock.RLock()
+	defer c.writeLock.RUnlock()
+	if c.closed {
+		err = ErrClosed
+		return
+	}
+	pooled := getBuffer(packetOverhead + len(b))
+	defer putBuffer(pooled)
+	datagram := (*pooled)[:24]
+	_, err = io.ReadFull(c.rand, datagram)
+	if err != nil {
+		return
+	}
+	var nonce [24]byte
+	copy(nonce[:], datagram)
+	plain := make([]byte, 8, 8+len(b))
+	binary.LittleEndian.PutUint64(plain, atomic.AddUint64(&c.writeSequence, 1))
+	plain = append(plain, b...)
+	datagram = box.SealAfterPrecomputation(datagram, plain, &nonce, c.sendKey)
+	wipe(plain)
+	_, err = c.PacketConn.WriteTo(datagram, c.peer)
+	if err != nil {
+		return
+	}
+	n = len(b)
+	return
+}
+
+// Pending reads and writes finish before the keys are wiped, later ones fail
+func (c *packetConn) Close() (err error) {
+	err = c.PacketConn.Close()
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.closed = true
+	wipeKey(c.privateKey)
+	wipeKey(c.sendKey)
+	wipeKey(c.recvKey)
+	wipe(c.plaintext[:cap(c.plaintext)])
+	return
+}
+
+const replayWindowSize = 64
+
+// Tracks the highest sequence number seen and which of the preceding ones arrived.
+// Sequence numbers start at 1, older than the window counts as a replay
+type replayWindow struct {
+	highest uint64
+	seen    uint64
+}
+
+func (w *replayWindow) accept(sequence uint64) bool {
+	if sequence == 0 {
+		return false
+	}
+	if sequence > w.highest {
+		shift := sequence - w.highest
+		if shift >= replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.highest = sequence
+		return true
+	}
+	offset := w.highest - sequence
+	if offset >= replayWindowSize || w.seen&(1<<offset) != 0 {
+		return false
+	}
+	w.seen |= 1 << offset
+	return true
+}
@@ -0,0 +1,184 @@
+package securenet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type packetEnds struct {
+	client, server     PacketConn
+	clientPC, serverPC net.PacketConn
+}
+
+func testPacketConns(t *testing.T, clientConfig, serverConfig *Config) (e packetEnds) {
+	t.Helper()
+	var err error
+	e.serverPC, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.clientPC, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		e.server, err = WrapPacketServer(e.serverPC, serverConfig)
+		done <- err
+	}()
+	e.client, err = WrapPacket(e.clientPC, e.serverPC.LocalAddr(), clientConfig)
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		e.client.Close()
+		e.server.Close()
+	})
+	return
+}
+
+// The next datagram on pc, read past the PacketConn wrapping it
+func readRaw(t *testing.T, pc net.PacketConn) []byte {
+	t.Helper()
+	b := make([]byte, maxDatagramSize)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	defer pc.SetReadDeadline(time.Time{})
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b[:n]
+}
+
+func readPacket(t *testing.T, c PacketConn) string {
+	t.Helper()
+	b := make([]byte, 100)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b[:n])
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, version := range []uint8{Version7, Version8} {
+		e := testPacketConns(t, &Config{MaxVersion: version}, nil)
+		if *e.client.GetPublicKey() != *e.server.GetPublicKey() || *e.client.GetServerPublicKey() != *e.server.GetServerPublicKey() {
+			t.Fatal("both ends disagree on the keys")
+		}
+		for i := 0; i < 3; i++ {
+			e.client.WriteTo([]byte("to server"), nil)
+			if got := readPacket(t, e.server); got != "to server" {
+				t.Fatal(version, got)
+			}
+		}
+		e.server.WriteTo([]byte("to client"), nil)
+		if got := readPacket(t, e.client); got != "to client" {
+			t.Fatal(version, got)
+		}
+	}
+}
+
+func TestPacketReflected(t *testing.T) {
+	e := testPacketConns(t, nil, nil)
+	e.client.WriteTo([]byte("reflected"), nil)
+	datagram := readRaw(t, e.serverPC)
+	e.serverPC.WriteTo(datagram, e.clientPC.LocalAddr())
+	e.server.WriteTo([]byte("from server"), nil)
+	if got := readPacket(t, e.client); got != "from server" {
+		t.Fatal(got)
+	}
+}
+
+func TestPacketReplayedAcrossSessions(t *testing.T) {
+	clientConfig, serverConfig := testKeys(t), testKeys(t)
+	first := testPacketConns(t, clientConfig, serverConfig)
+	first.client.WriteTo([]byte("replayed"), nil)
+	datagram := readRaw(t, first.serverPC)
+
+	second := testPacketConns(t, clientConfig, serverConfig)
+	second.clientPC.WriteTo(datagram, second.serverPC.LocalAddr())
+	second.client.WriteTo([]byte("fresh"), nil)
+	if got := readPacket(t, second.server); got != "fresh" {
+		t.Fatal(got)
+	}
+}
+
+func TestPacketCloseWipesKeys(t *testing.T) {
+	e := testPacketConns(t, nil, nil)
+	c := e.client.(*packetConn)
+	c.Close()
+	var zero [32]byte
+	if *c.sendKey != zero || *c.recvKey != zero || *c.privateKey != zero {
+		t.Fatal("keys left after Close")
+	}
+}
+
+// RemoteAddr is the peer of the handshake and LocalAddr that of the PacketConn
+func TestPacketAddr(t *testing.T) {
+	e := testPacketConns(t, nil, nil)
+	if e.client.LocalAddr() != e.clientPC.LocalAddr() || e.server.LocalAddr() != e.serverPC.LocalAddr() {
+		t.Fatal(e.client.LocalAddr(), e.server.LocalAddr())
+	}
+	if e.client.RemoteAddr().String() != e.serverPC.LocalAddr().String() || e.server.RemoteAddr().String() != e.clientPC.LocalAddr().String() {
+		t.Fatal(e.client.RemoteAddr(), e.server.RemoteAddr())
+	}
+}
+
+// Close waits for a WriteTo sealing under the key, later writes fail
+func TestPacketCloseWhileWriting(t *testing.T) {
+	e := testPacketConns(t, nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := e.client.WriteTo([]byte("racing"), nil); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	e.client.Close()
+	<-done
+	if _, err := e.client.WriteTo([]byte("late"), nil); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+// Without a handshake timeout the server keeps the read deadline of its PacketConn
+func TestPacketServerKeepsDeadline(t *testing.T) {
+	serverPC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverPC.Close()
+	serverPC.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = WrapPacketServer(serverPC, nil); err != ErrHandshakeTimeout {
+		t.Fatal(err)
+	}
+
+	e := packetEnds{serverPC: serverPC}
+	e.clientPC, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.clientPC.Close()
+	serverPC.SetReadDeadline(time.Now().Add(time.Second))
+	go func() {
+		e.client, _ = WrapPacket(e.clientPC, serverPC.LocalAddr(), nil)
+	}()
+	e.server, err = WrapPacketServer(serverPC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = e.server.ReadFrom(make([]byte, 10)); !isTimeout(err) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package securenet
+
+import "net"
+
+// Pipe returns the client and server ends of a net.Pipe, both with fresh keys
+// and already handshaked. Nothing is buffered, so each write blocks until the
+// other end reads it, as with net.Pipe
+func Pipe() (client, server Conn, err error) {
+	clientPub, clientPriv, clientElligator, err := GenerateKeys()
+	if err != nil {
+		return
+	}
+	serverPub, serverPriv, serverElligator, err := GenerateKeys()
+	if err != nil {
+		return
+	}
+	a, b := net.Pipe()
+
+	type result struct {
+		conn Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		s, err := WrapServer(b, serverPub, serverPriv, serverElligator)
+		accepted <- result{s, err}
+	}()
+	client, err = WrapClient(a, clientPub, clientPriv, clientElligator)
+	if err != nil {
+		a.Close()
+		b.Close()
+		<-accepted
+		return nil, nil, err
+	}
+	r := <-accepted
+	if r.err != nil {
+		client.Close()
+		b.Close()
+		return nil, nil, r.err
+	}
+	server = r.conn
+	return
+}
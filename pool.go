@@ -0,0 +1,33 @@
+package securenet
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Nonce, sealed header and the box overhead of the body
+const frameOverhead = 24 + box.Overhead + headerSize + box.Overhead
+
+// Holds ciphertext, and plaintext only while it is wiped before the buffer
+// is returned. Plaintext handed to callers is never pooled
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, DefaultChunkSize+frameOverhead)
+		return &b
+	},
+}
+
+// Buffers grow to the largest frame they were used for
+func getBuffer(size int) *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size)
+	}
+	*b = (*b)[:size]
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	bufferPool.Put(b)
+}
@@ -0,0 +1,37 @@
+package securenet
+
+import (
+	"io"
+	"testing"
+)
+
+// Allocations per frame written and read, most of which the buffer pool saves
+func benchmarkFrames(b *testing.B, size int) {
+	client, server := testConns(b, nil, nil)
+	data := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	done := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, size)
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadFull(server, buffer); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkFrames1K(b *testing.B)  { benchmarkFrames(b, 1<<10) }
+func BenchmarkFrames64K(b *testing.B) { benchmarkFrames(b, DefaultChunkSize) }
@@ -0,0 +1,265 @@
+package securenet
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A rehandshake exchanges fresh ephemeral keys in control frames sealed under
+// the current keys. The new session key mixes the old one with the ephemeral
+// DH, so only the peer of the original handshake can complete it.
+//
+// The initiator sends a request, the responder answers and seals everything
+// after the answer under its new send key, and the initiator confirms and seals
+// everything after the confirmation under its new send key. Frames sent before
+// these markers are read under the old keys. This only completes while a read
+// is pending on both ends. When both ends start one at once, the client's wins
+// and the server's Rehandshake returns once the client's completed. After a
+// Noise handshake this fails with ErrNoiseTransport
+func (c *conn) Rehandshake(ctx context.Context) (err error) {
+	err = c.handshakeFirst(ctx)
+	if err != nil {
+		return
+	}
+	c.stateLock.RLock()
+	complete, noise := c.handshakeComplete, c.noise
+	c.stateLock.RUnlock()
+	if !complete {
+		return ErrNotHandshaked
+	}
+	if noise {
+		return ErrNoiseTransport
+	}
+
+	round, err := c.requestRehandshake()
+	if err != nil {
+		return
+	}
+	select {
+	case <-round.done:
+		err = round.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.done:
+		err = ErrClosed
+	}
+	return
+}
+
+type rehandshakeRound struct {
+	done chan struct{}
+	// Only valid once done is closed
+	err error
+}
+
+func (r *rehandshakeRound) finish(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// All rehandshake frames go through the control queue, so once the request
+// is queued every answer the reader queues later goes out after it
+func (c *conn) requestRehandshake() (round *rehandshakeRound, err error) {
+	c.rehandshakeLock.Lock()
+	defer c.rehandshakeLock.Unlock()
+	if c.rehandshake != nil {
+		return c.rehandshake, nil
+	}
+	ePub, ePriv, err := box.GenerateKey(c.rand)
+	if err != nil {
+		return
+	}
+	round = &rehandshakeRound{done: make(chan struct{})}
+	c.rehandshakePriv = ePriv
+	c.rehandshake = round
+	c.queueControl(func() {
+		err := c.writeRawFrame(frameRehandshakeRequest, ePub[:])
+		if err == nil {
+			return
+		}
+		c.rehandshakeLock.Lock()
+		defer c.rehandshakeLock.Unlock()
+		if c.rehandshake == round {
+			wipe(c.rehandshakePriv[:])
+			c.rehandshakePriv = nil
+			c.rehandshake = nil
+			round.finish(err)
+		}
+	})
+	return
+}
+
+// Called by the reader, the answer is queued so the reader never waits on writers
+func (c *conn) handleRehandshakeRequest(b []byte) (err error) {
+	peerEphemeral, err := rehandshakeKey(b)
+	if err != nil {
+		return
+	}
+	c.rehandshakeLock.Lock()
+	defer c.rehandshakeLock.Unlock()
+	if c.rehandshakePriv != nil {
+		if !c.isServer {
+			return
+		}
+		wipe(c.rehandshakePriv[:])
+		c.rehandshakePriv = nil
+	}
+	ePub, ePriv, err := box.GenerateKey(c.rand)
+	if err != nil {
+		return
+	}
+	defer wipe(ePriv[:])
+	sendKey, recvKey := c.rehandshakeKeys(peerEphemeral, ePriv)
+	c.pendingRecvKey = recvKey
+
+	c.queueControl(func() {
+		if c.writeRawFrame(frameRehandshakeResponse, ePub[:]) == nil {
+			c.swapSendKey(sendKey)
+		}
+	})
+	return
+}
+
+func (c *conn) handleRehandshakeResponse(b []byte) (err error) {
+	peerEphemeral, err := rehandshakeKey(b)
+	if err != nil {
+		return
+	}
+	c.rehandshakeLock.Lock()
+	defer c.rehandshakeLock.Unlock()
+	if c.rehandshakePriv == nil {
+		return fmt.Errorf("%w: unexpected rehandshake response", ErrMalformedFrame)
+	}
+	sendKey, recvKey := c.rehandshakeKeys(peerEphemeral, c.rehandshakePriv)
+	wipe(c.rehandshakePriv[:])
+	c.rehandshakePriv = nil
+	wipe(c.recvKey[:])
+	c.recvKey = recvKey
+	round := c.rehandshake
+	c.rehandshake = nil
+
+	c.queueControl(func() {
+		err := c.writeRawFrame(frameRehandshakeConfirm, nil)
+		if err == nil {
+			c.swapSendKey(sendKey)
+		}
+		round.finish(err)
+	})
+	return
+}
+
+func (c *conn) handleRehandshakeConfirm() (err error) {
+	c.rehandshakeLock.Lock()
+	defer c.rehandshakeLock.Unlock()
+	if c.pendingRecvKey == nil {
+		return fmt.Errorf("%w: unexpected rehandshake confirmation", ErrMalformedFrame)
+	}
+	wipe(c.recvKey[:])
+	c.recvKey = c.pendingRecvKey
+	c.pendingRecvKey = nil
+	// Without a private key, the pending request is one the server dropped for the client's
+	if c.rehandshake != nil && c.rehandshakePriv == nil {
+		c.rehandshake.finish(nil)
+		c.rehandshake = nil
+	}
+	return
+}
+
+func rehandshakeKey(b []byte) (key *[32]byte, err error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("%w: rehandshake frame of %d bytes", ErrMalformedFrame, len(b))
+	}
+	key = new([32]byte)
+	copy(key[:], b)
+	if isLowOrder(key) {
+		return nil, ErrInvalidPeerKey
+	}
+	return
+}
+
+// This replaces the session key and returns the new keys for both directions
+func (c *conn) rehandshakeKeys(peerEphemeral, ePriv *[32]byte) (sendKey, recvKey *[32]byte) {
+	var ee [32]byte
+	box.Precompute(&ee, peerEphemeral, ePriv)
+	defer wipe(ee[:])
+
+	c.stateLock.Lock()
+	shared := mixKeys("securenet rehandshake", c.sharedKey, &ee)
+	wipe(c.sharedKey[:])
+	c.sharedKey = shared
+	c.stateLock.Unlock()
+
+	if c.version < Version3 {
+		sendKey, recvKey = new([32]byte), new([32]byte)
+		*sendKey, *recvKey = *shared, *shared
+		return
+	}
+	clientToServer := directionKey(shared, "securenet client to server", c.PublicKey, c.ServerPublicKey)
+	serverToClient := directionKey(shared, "securenet server to client", c.PublicKey, c.ServerPublicKey)
+	if c.isServer {
+		return serverToClient, clientToServer
+	}
+	return clientToServer, serverToClient
+}
+
+// Queued actions run under writeLock in the order they were queued, so the
+// markers of consecutive rehandshakes go out under the keys the peer expects.
+// One goroutine runs them, however many are queued while it waits for writeLock
+func (c *conn) queueControl(action func()) {
+	c.controlLock.Lock()
+	defer c.controlLock.Unlock()
+	c.controlQueue = append(c.controlQueue, action)
+	if !c.controlFlushing {
+		c.controlFlushing = true
+		go c.flushControl()
+	}
+}
+
+// Replies to keepalives and pings, which a peer may send faster than it reads
+// the replies. Beyond maxPendingReplies they are dropped, so the peer's pings
+// time out instead of the queue growing
+func (c *conn) queueReply(frameType byte, b []byte) {
+	c.controlLock.Lock()
+	if c.pendingReplies >= maxPendingReplies {
+		c.controlLock.Unlock()
+		return
+	}
+	c.pendingReplies++
+	c.controlLock.Unlock()
+	c.queueControl(func() {
+		c.controlLock.Lock()
+		c.pendingReplies--
+		c.controlLock.Unlock()
+		c.writeRawFrame(frameType, b)
+	})
+}
+
+func (c *conn) flushControl() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	for {
+		c.controlLock.Lock()
+		if len(c.controlQueue) == 0 {
+			c.controlFlushing = false
+			c.controlLock.Unlock()
+			return
+		}
+		action := c.controlQueue[0]
+		c.controlQueue = c.controlQueue[1:]
+		c.controlLock.Unlock()
+		action()
+	}
+}
+
+// Callers hold writeLock
+func (c *conn) swapSendKey(key *[32]byte) {
+	wipe(c.sendKey[:])
+	c.sendKey = key
+	if c.sentNonces != nil {
+		c.sentNonces = newNonceHistory()
+	}
+	c.sentSinceRekey = 0
+	c.framesSinceRekey = 0
+}
@@ -0,0 +1,117 @@
+package securenet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Control frames that make no sense fail the read rather than being skipped
+func TestUnexpectedControlFrames(t *testing.T) {
+	for _, frameType := range []byte{frameRehandshakeConfirm, frameTicket} {
+		client, server := testConns(t, nil, nil)
+		if err := client.(*conn).writeControl(frameType, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.ReadMessage(); !errors.Is(err, ErrMalformedFrame) {
+			t.Fatal(frameType, err)
+		}
+	}
+}
+
+// Reads on both ends until they close, the server echoing every message and
+// the client passing them on, since a rehandshake needs a read on both ends
+func rehandshakeEcho(client, server Conn) (echoed <-chan []byte) {
+	go func() {
+		for {
+			m, err := server.ReadMessage()
+			if err != nil || server.WriteMessage(m) != nil {
+				return
+			}
+		}
+	}()
+	messages := make(chan []byte, 16)
+	go func() {
+		defer close(messages)
+		for {
+			m, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- m
+		}
+	}()
+	return messages
+}
+
+func sessionKey(c Conn) [32]byte {
+	s := c.(*conn)
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	return *s.sharedKey
+}
+
+func testEcho(t *testing.T, client Conn, echoed <-chan []byte, message string) {
+	t.Helper()
+	if err := client.WriteMessage([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-echoed:
+		if string(m) != message {
+			t.Fatal(string(m))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo")
+	}
+}
+
+func TestRehandshake(t *testing.T) {
+	for _, initiator := range []string{"Client", "Server"} {
+		t.Run(initiator, func(t *testing.T) {
+			client, server := testConns(t, nil, nil)
+			echoed := rehandshakeEcho(client, server)
+			testEcho(t, client, echoed, "before")
+			old := sessionKey(client)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c := client
+			if initiator == "Server" {
+				c = server
+			}
+			if err := c.Rehandshake(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if key := sessionKey(client); key == old || key != sessionKey(server) {
+				t.Fatal("session key not replaced on both ends")
+			}
+			testEcho(t, client, echoed, "after")
+		})
+	}
+}
+
+// When both ends start one at once the client's wins and both return
+func TestSimultaneousRehandshake(t *testing.T) {
+	client, server := testConns(t, nil, nil)
+	echoed := rehandshakeEcho(client, server)
+	old := sessionKey(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Rehandshake(ctx)
+	}()
+	if err := client.Rehandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if key := sessionKey(client); key == old || key != sessionKey(server) {
+		t.Fatal("session key not replaced on both ends")
+	}
+	testEcho(t, client, echoed, "after")
+}
@@ -0,0 +1,348 @@
+package securenet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Servers issue tickets valid this long unless Config.TicketLifetime is set
+const DefaultTicketLifetime = 24 * time.Hour
+
+// Rotating drops the oldest keys beyond this many
+const maxTicketKeys = 3
+
+// Resumption hellos set this bit in the version byte, no full hello does
+const resumeFlag = 0x80
+
+// Longer tickets are refused without reading them
+const maxTicketSize = 1024
+
+// Issue time, version, AEAD ID, client public key and resumption secret
+const ticketPlaintextSize = 8 + 1 + 1 + 32 + 32
+
+// Tickets are sealed under the first key and opened with any of them, servers
+// sharing one TicketKeys accept each other's tickets. Anyone holding a key can
+// decrypt every session resumed from a ticket sealed under it, so keys should be
+// rotated often and are never written anywhere
+type TicketKeys struct {
+	lock sync.RWMutex
+	keys [][32]byte
+}
+
+// The keyring starts out with one fresh key
+func NewTicketKeys() (k *TicketKeys, err error) {
+	k = &TicketKeys{}
+	err = k.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// New tickets are sealed under a fresh key, and tickets sealed under the oldest
+// key stop working once maxTicketKeys newer ones were added
+func (k *TicketKeys) Rotate() (err error) {
+	var key [32]byte
+	_, err = io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys = append([][32]byte{key}, k.keys...)
+	if len(k.keys) > maxTicketKeys {
+		wipe(k.keys[maxTicketKeys][:])
+		k.keys = k.keys[:maxTicketKeys]
+	}
+	return
+}
+
+func (k *TicketKeys) seal(plaintext []byte, r io.Reader) (ticket []byte, err error) {
+	var nonce [24]byte
+	_, err = io.ReadFull(r, nonce[:])
+	if err != nil {
+		return
+	}
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return secretbox.Seal(nonce[:], plaintext, &nonce, &k.keys[0]), nil
+}
+
+func (k *TicketKeys) open(ticket []byte) (plaintext []byte, ok bool) {
+	if len(ticket) < 24+secretbox.Overhead {
+		return
+	}
+	var nonce [24]byte
+	copy(nonce[:], ticket)
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	for i := range k.keys {
+		plaintext, ok = secretbox.Open(nil, ticket[24:], &nonce, &k.keys[i])
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+// A client resumes the session the ticket was issued for by setting
+// Config.SessionTicket, which skips the DH of the handshake. The secret lets
+// anyone resume as the client until the ticket expires, so this must be stored
+// as carefully as a private key
+type SessionTicket struct {
+	// Opaque to the client, sealed under the server's TicketKeys
+	Ticket          []byte
+	Secret          [32]byte
+	ClientPublicKey [32]byte
+	ServerPublicKey [32]byte
+	Version         uint8
+	AEAD            byte
+	Expires         time.Time
+}
+
+// Tickets for other keypairs, pinned servers or past their expiry are skipped
+func (c *Config) sessionTicket(pub *[32]byte) *SessionTicket {
+	if c == nil || c.SessionTicket == nil {
+		return nil
+	}
+	t := c.SessionTicket
+	if t.ClientPublicKey != *pub || time.Now().After(t.Expires) || len(t.Ticket) > maxTicketSize {
+		return nil
+	}
+	if c.ServerPublicKey != nil && !EqualKeys(c.ServerPublicKey, &t.ServerPublicKey) {
+		return nil
+	}
+	return t
+}
+
+// The client sends random bytes in place of a representative, the version
+// with resumeFlag set and the ticket, prefixed by its length. The server answers
+// with random bytes and the version with resumeFlag set, followed by its
+// MaxFrameSize from version 6 on and its codec ID from version 9 on, or a zero version byte when it refuses the
+// ticket, after which both run a full handshake. Noise handshakes never resume
+func (h *handshake) resume() (peerKey, shared [32]byte, resumed bool, err error) {
+	if h.config != nil && h.config.Noise {
+		return
+	}
+	if h.server {
+		return h.resumeServer()
+	}
+	ticket := h.config.sessionTicket(h.pub)
+	if ticket == nil {
+		return
+	}
+	aead, err := clientAEAD(ticket.AEAD, h.config)
+	if err != nil {
+		return
+	}
+
+	hello := make([]byte, helloSize+2, helloSize+2+len(ticket.Ticket))
+	_, err = io.ReadFull(h.config.rand(), hello[:32])
+	if err != nil {
+		return
+	}
+	hello[32] = resumeFlag | ticket.Version
+	binary.LittleEndian.PutUint16(hello[helloSize:], uint16(len(ticket.Ticket)))
+	hello = append(hello, ticket.Ticket...)
+	err = writeFull(h.oc, hello)
+	if err != nil {
+		return
+	}
+
+	var reply [helloSize]byte
+	_, err = io.ReadFull(h.bRead, reply[:])
+	if err != nil {
+		return
+	}
+	if reply[32] == 0 {
+		return
+	}
+	if reply[32] != resumeFlag|ticket.Version {
+		err = fmt.Errorf("%w: resumption answered with version byte %d", ErrHandshake, reply[32])
+		return
+	}
+	err = h.verifyServer(&ticket.ServerPublicKey)
+	if err != nil {
+		return
+	}
+	h.transcript = append(append(h.transcript, hello...), reply[:]...)
+	if ticket.Version >= Version6 {
+		err = h.readFrameSize()
+		if err != nil {
+			return
+		}
+	}
+	if ticket.Version >= Version9 {
+		err = h.readCompression()
+		if err != nil {
+			return
+		}
+	}
+	h.version, h.aead = ticket.Version, aead
+	if h.version >= Version8 {
+		h.clientRandom, h.serverRandom = hello[:32], reply[:32]
+	}
+	peerKey = ticket.ServerPublicKey
+	shared = *mixKeys("securenet resumption", &ticket.Secret)
+	resumed = true
+	return
+}
+
+// Without TicketKeys every ticket is refused
+func (h *handshake) resumeServer() (peerKey, shared [32]byte, resumed bool, err error) {
+	hello := make([]byte, helloSize+2)
+	_, err = io.ReadFull(h.bRead, hello[:helloSize])
+	if err != nil {
+		return
+	}
+	if hello[32]&resumeFlag == 0 {
+		h.firstHello = new([helloSize]byte)
+		copy(h.firstHello[:], hello)
+		return
+	}
+	_, err = io.ReadFull(h.bRead, hello[helloSize:])
+	if err != nil {
+		return
+	}
+	length := binary.LittleEndian.Uint16(hello[helloSize:])
+	if length > maxTicketSize {
+		err = fmt.Errorf("%w: ticket of %d bytes", ErrHandshake, length)
+		return
+	}
+	hello = append(hello, make([]byte, length)...)
+	_, err = io.ReadFull(h.bRead, hello[helloSize+2:])
+	if err != nil {
+		return
+	}
+
+	var reply [helloSize]byte
+	_, err = io.ReadFull(h.config.rand(), reply[:32])
+	if err != nil {
+		return
+	}
+	plaintext, ok := h.openTicket(hello[helloSize+2:], hello[32]&^resumeFlag)
+	if !ok {
+		err = writeFull(h.oc, reply[:])
+		return
+	}
+	defer wipe(plaintext)
+	copy(peerKey[:], plaintext[10:])
+	err = h.authorizeClient(&peerKey)
+	if err != nil {
+		return
+	}
+	reply[32] = hello[32]
+	accepted := reply[:]
+	if plaintext[8] >= Version6 {
+		accepted = appendFrameSize(accepted, h.config)
+	}
+	if plaintext[8] >= Version9 {
+		accepted = append(accepted, h.config.compressionID())
+	}
+	err = writeFull(h.oc, accepted)
+	if err != nil {
+		return
+	}
+	h.transcript = append(append(h.transcript, hello...), accepted...)
+	h.version, h.aead = plaintext[8], NaClBox
+	if h.version >= Version4 {
+		h.aead = h.config.aead()
+	}
+	if h.version >= Version8 {
+		h.clientRandom, h.serverRandom = hello[:32], reply[:32]
+	}
+	var secret [32]byte
+	copy(secret[:], plaintext[42:])
+	defer wipe(secret[:])
+	shared = *mixKeys("securenet resumption", &secret)
+	resumed = true
+	return
+}
+
+// Tickets are refused once expired, or when the version or AEAD they were issued
+// for is no longer what this server would pick
+func (h *handshake) openTicket(ticket []byte, version uint8) (plaintext []byte, ok bool) {
+	keys := h.config.ticketKeys()
+	if keys == nil {
+		return
+	}
+	plaintext, ok = keys.open(ticket)
+	if !ok || len(plaintext) != ticketPlaintextSize {
+		return nil, false
+	}
+	issued := time.Unix(int64(binary.LittleEndian.Uint64(plaintext)), 0)
+	ok = time.Since(issued) < h.config.ticketLifetime() &&
+		plaintext[8] == version && version >= minVersion && version <= h.config.maxVersion() &&
+		(version < Version4 || plaintext[9] == h.config.aead().ID())
+	if !ok {
+		wipe(plaintext)
+		plaintext = nil
+	}
+	return
+}
+
+// The resumption secret is derived from the session key right after the handshake
+func resumptionSecret(shared *[32]byte) *[32]byte {
+	return mixKeys("securenet resumption secret", shared)
+}
+
+// A ticket frame is the lifetime in seconds followed by the ticket.
+// Callers hold writeLock
+func (c *conn) issueTicket(keys *TicketKeys) (err error) {
+	secret := resumptionSecret(c.sharedKey)
+	defer wipe(secret[:])
+	plaintext := make([]byte, ticketPlaintextSize)
+	defer wipe(plaintext)
+	binary.LittleEndian.PutUint64(plaintext, uint64(time.Now().Unix()))
+	plaintext[8] = c.version
+	plaintext[9] = c.aead.ID()
+	copy(plaintext[10:], c.PublicKey[:])
+	copy(plaintext[42:], secret[:])
+	ticket, err := keys.seal(plaintext, c.rand)
+	if err != nil {
+		return
+	}
+	frame := make([]byte, 4, 4+len(ticket))
+	binary.LittleEndian.PutUint32(frame, uint32(c.config.ticketLifetime()/time.Second))
+	return c.writeRawFrame(frameTicket, append(frame, ticket...))
+}
+
+// Only clients accept tickets, the latest one replaces any earlier
+func (c *conn) handleTicket(b []byte) (err error) {
+	if c.isServer || c.resumptionSecret == nil || len(b) < 4 || len(b)-4 > maxTicketSize {
+		return fmt.Errorf("%w: unexpected session ticket", ErrMalformedFrame)
+	}
+	lifetime := time.Duration(binary.LittleEndian.Uint32(b)) * time.Second
+	ticket := &SessionTicket{
+		Ticket:          append([]byte{}, b[4:]...),
+		Secret:          *c.resumptionSecret,
+		ClientPublicKey: *c.PublicKey,
+		ServerPublicKey: *c.ServerPublicKey,
+		Version:         c.version,
+		AEAD:            c.aead.ID(),
+		Expires:         time.Now().Add(lifetime),
+	}
+	c.stateLock.Lock()
+	c.ticket = ticket
+	c.stateLock.Unlock()
+	return
+}
+
+// The ticket the server issued on this connection, nil until one arrived.
+// Tickets are only received while reading
+func (c *conn) SessionTicket() *SessionTicket {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	if c.ticket == nil {
+		return nil
+	}
+	ticket := *c.ticket
+	ticket.Ticket = append([]byte{}, c.ticket.Ticket...)
+	return &ticket
+}
@@ -0,0 +1,108 @@
+package securenet
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+// The ticket issued on a connection between these configs
+func issuedTicket(t *testing.T, clientConfig, serverConfig *Config) *SessionTicket {
+	t.Helper()
+	client, server := testConns(t, clientConfig, serverConfig)
+	go server.WriteMessage([]byte("ticket"))
+	if _, err := client.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	ticket := client.SessionTicket()
+	if ticket == nil {
+		t.Fatal("no ticket")
+	}
+	return ticket
+}
+
+func testResumed(t *testing.T, clientConfig, serverConfig *Config, resumed bool) {
+	t.Helper()
+	client, server := testConns(t, clientConfig, serverConfig)
+	if state := client.ConnectionState(); state.Resumed != resumed {
+		t.Fatal("resumed", state.Resumed)
+	}
+	if state := server.ConnectionState(); state.Resumed != resumed || state.PeerPublicKey != client.ConnectionState().LocalPublicKey {
+		t.Fatal("server resumed", state.Resumed)
+	}
+	go client.WriteMessage([]byte("resumed"))
+	if m, err := server.ReadMessage(); err != nil || string(m) != "resumed" {
+		t.Fatal(string(m), err)
+	}
+	go server.WriteMessage([]byte("back"))
+	if m, err := client.ReadMessage(); err != nil || string(m) != "back" {
+		t.Fatal(string(m), err)
+	}
+}
+
+func TestResumption(t *testing.T) {
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := testKeys(t)
+	serverConfig.TicketKeys = keys
+	clientConfig := testKeys(t)
+	clientConfig.SessionTicket = issuedTicket(t, clientConfig, serverConfig)
+	testResumed(t, clientConfig, serverConfig, true)
+}
+
+// A refused ticket falls back to a full handshake on the same connection
+func TestRefusedTicket(t *testing.T) {
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := testKeys(t)
+	serverConfig.TicketKeys = keys
+	clientConfig := testKeys(t)
+	clientConfig.SessionTicket = issuedTicket(t, clientConfig, serverConfig)
+	expired := *serverConfig
+	expired.TicketLifetime = time.Nanosecond
+	for _, tc := range []struct {
+		name   string
+		server *Config
+	}{
+		{"NoTicketKeys", &Config{PrivateKey: serverConfig.PrivateKey, Representative: serverConfig.Representative}},
+		{"OtherTicketKeys", &Config{PrivateKey: serverConfig.PrivateKey, Representative: serverConfig.Representative, TicketKeys: otherKeys}},
+		{"Expired", &expired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testResumed(t, clientConfig, tc.server, false)
+		})
+	}
+}
+
+func TestRotateTicketKeys(t *testing.T) {
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket, err := keys.seal([]byte("plaintext"), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < maxTicketKeys; i++ {
+		if err = keys.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := keys.open(ticket); !ok {
+			t.Fatal("ticket refused after", i, "rotations")
+		}
+	}
+	if err = keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys.open(ticket); ok || len(keys.keys) != maxTicketKeys {
+		t.Fatal("kept", len(keys.keys), "keys")
+	}
+}
@@ -0,0 +1,104 @@
+package securenet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// Both ends of a TLS connection over loopback, with a throwaway certificate
+func tlsPair(t *testing.T) (client, server *tls.Conn) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	a, b := tcpPair(t)
+	server = tls.Server(b, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	client = tls.Client(a, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	err = client.Handshake()
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestOverTLS(t *testing.T) {
+	a, b := tlsPair(t)
+	var server Conn
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = Server(b, nil)
+		done <- err
+	}()
+	client, err := Client(a, nil)
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	want := randomBytes(t, 200000)
+	go func() {
+		client.Write(want)
+		client.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(server)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatal(len(got), err)
+	}
+	if err = server.WriteMessage([]byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := client.ReadMessage(); err != nil || string(m) != "back" {
+		t.Fatal(m, err)
+	}
+
+	// A read timeout leaves both layers usable
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Time{})
+	go server.WriteMessage([]byte("again"))
+	if m, err := client.ReadMessage(); err != nil || string(m) != "again" {
+		t.Fatal(m, err)
+	}
+	if _, ok := client.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Fatal(client.RemoteAddr())
+	}
+}